@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+// BootstrapSpec is the declarative configuration applied to vault once it is initialized and unsealed
+type BootstrapSpec struct {
+	// Audit lists the audit devices to enable
+	Audit []BootstrapMount `json:"audit"`
+
+	// Policies maps ACL policy names to their HCL
+	Policies map[string]string `json:"policies"`
+
+	// Secrets lists the secrets engines to enable
+	Secrets []BootstrapMount `json:"secrets"`
+
+	// Auth lists the auth methods to enable and configure
+	Auth []BootstrapAuth `json:"auth"`
+
+	// RevokeRootToken revokes the root token once the spec is applied
+	RevokeRootToken bool `json:"revoke_root_token"`
+}
+
+// BootstrapMount is an audit device or secrets engine
+type BootstrapMount struct {
+	Path        string                 `json:"path"`
+	Type        string                 `json:"type"`
+	Description string                 `json:"description"`
+	Options     map[string]interface{} `json:"options"`
+}
+
+// BootstrapAuth is an auth method with its configuration and roles
+type BootstrapAuth struct {
+	BootstrapMount
+
+	// Config is written to auth/<path>/config
+	Config map[string]interface{} `json:"config"`
+
+	// Roles are written to auth/<path>/role/<name>
+	Roles map[string]map[string]interface{} `json:"roles"`
+}
+
+// Bootstrapper applies a BootstrapSpec once per process, as soon as vault is active
+type Bootstrapper struct {
+	spec    BootstrapSpec
+	store   KeyStore
+	elector *LeaderElector
+
+	// rootToken is the root token returned by Initialize, used before any stored one
+	rootToken string
+
+	mu   sync.Mutex
+	done bool
+}
+
+// NewBootstrapper - reads the spec from BOOTSTRAP_CONFIG, returning nil if it is not set
+func NewBootstrapper(store KeyStore, elector *LeaderElector) (*Bootstrapper, error) {
+	path := os.Getenv("BOOTSTRAP_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := BootstrapSpec{}
+	if err := yaml.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for _, mounts := range [][]BootstrapMount{spec.Audit, spec.Secrets} {
+		for _, m := range mounts {
+			if m.Path == "" || m.Type == "" {
+				return nil, fmt.Errorf("%s: every audit device and secrets engine needs a path and type", path)
+			}
+		}
+	}
+	for _, a := range spec.Auth {
+		if a.Path == "" || a.Type == "" {
+			return nil, fmt.Errorf("%s: every auth method needs a path and type", path)
+		}
+	}
+
+	return &Bootstrapper{spec: spec, store: store, elector: elector}, nil
+}
+
+// SetRootToken - remembers the root token returned by Initialize
+func (b *Bootstrapper) SetRootToken(token string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rootToken = token
+}
+
+// Apply - applies the spec to vault unless it was already applied by this process, retrying on the next call after a failure
+func (b *Bootstrapper) Apply(vault *VaultClient) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.done {
+		return
+	}
+
+	if b.elector != nil {
+		leader, err := b.elector.TryAcquire()
+		if err != nil {
+			logger.Warnf("Could not acquire lease %s: %s", b.elector.Name, err)
+			return
+		}
+		if !leader {
+			return
+		}
+
+		defer func() {
+			if err := b.elector.Release(); err != nil {
+				logger.Warnf("Could not release lease %s: %s", b.elector.Name, err)
+			}
+		}()
+	}
+
+	token, temporary, err := b.token(vault)
+	if err != nil {
+		logger.Warnf("Could not get a root token to bootstrap vault: %s", err)
+		return
+	}
+
+	client := &VaultClient{Addr: vault.Addr, Token: token}
+
+	if err := client.ApplyBootstrap(b.spec); err != nil {
+		logger.Warnf("Could not bootstrap vault: %s", err)
+	} else {
+		logger.Infof("Vault bootstrap applied")
+		b.done = true
+	}
+
+	if temporary || (b.done && b.spec.RevokeRootToken) {
+		if err := client.RevokeSelf(); err != nil {
+			logger.Warnf("Could not revoke the root token: %s", err)
+			return
+		}
+		logger.Infof("Root token revoked")
+		b.rootToken = ""
+	}
+}
+
+// token - returns the root token from Initialize, the stored root token, or a temporary one generated with the stored keys
+func (b *Bootstrapper) token(vault *VaultClient) (string, bool, error) {
+	candidates := []string{b.rootToken}
+
+	if rootStore, err := rootTokenStore(b.store); err == nil {
+		if token, err := rootStore.LoadRootToken(); err == nil {
+			candidates = append(candidates, token)
+		}
+	}
+
+	for _, token := range candidates {
+		if token == "" {
+			continue
+		}
+
+		// A PGP encrypted root token is not a valid token
+		if err := (&VaultClient{Addr: vault.Addr, Token: token}).request("GET", "/v1/auth/token/lookup-self", nil, nil); err == nil {
+			return token, false, nil
+		}
+	}
+
+	// The root token is missing, revoked or encrypted for an operator
+	logger.Infof("No usable root token is stored, generating a temporary one to bootstrap vault")
+	token, err := vault.GenerateRoot(b.store)
+	if err != nil {
+		return "", false, err
+	}
+
+	return token, true, nil
+}
+
+// ApplyBootstrap - enables the audit devices, secrets engines and auth methods of spec that are missing and writes its policies, auth configuration and roles
+func (v *VaultClient) ApplyBootstrap(spec BootstrapSpec) error {
+	audit, err := v.mounts("/v1/sys/audit")
+	if err != nil {
+		return err
+	}
+	for _, a := range spec.Audit {
+		if err := v.enable("/v1/sys/audit/", audit, a); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range spec.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := v.request("PUT", "/v1/sys/policies/acl/"+name, PolicyRequest{Policy: spec.Policies[name]}, nil); err != nil {
+			return fmt.Errorf("policy %s: %s", name, err)
+		}
+	}
+
+	secrets, err := v.mounts("/v1/sys/mounts")
+	if err != nil {
+		return err
+	}
+	for _, s := range spec.Secrets {
+		if err := v.enable("/v1/sys/mounts/", secrets, s); err != nil {
+			return err
+		}
+	}
+
+	auth, err := v.mounts("/v1/sys/auth")
+	if err != nil {
+		return err
+	}
+	for _, a := range spec.Auth {
+		if err := v.enable("/v1/sys/auth/", auth, a.BootstrapMount); err != nil {
+			return err
+		}
+
+		path := strings.Trim(a.Path, "/")
+		config := a.Config
+
+		// Vault in the cluster can review tokens with its own service account
+		if a.Type == "kubernetes" && config["kubernetes_host"] == nil {
+			if config == nil {
+				config = map[string]interface{}{}
+			}
+			config["kubernetes_host"] = "https://kubernetes.default.svc"
+		}
+
+		if config != nil {
+			if err := v.request("POST", "/v1/auth/"+path+"/config", config, nil); err != nil {
+				return fmt.Errorf("auth %s config: %s", path, err)
+			}
+		}
+
+		for name, role := range a.Roles {
+			if err := v.request("POST", "/v1/auth/"+path+"/role/"+name, role, nil); err != nil {
+				return fmt.Errorf("auth %s role %s: %s", path, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mounts - lists the audit devices, auth methods or secrets engines at path, keyed by their path with a trailing slash
+func (v *VaultClient) mounts(path string) (map[string]MountInfo, error) {
+	listing := struct {
+		Data map[string]MountInfo `json:"data"`
+	}{}
+
+	if err := v.request("GET", path, nil, &listing); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return listing.Data, nil
+}
+
+// enable - enables m under prefix unless existing already has it, failing if it exists with a different type
+func (v *VaultClient) enable(prefix string, existing map[string]MountInfo, m BootstrapMount) error {
+	path := strings.Trim(m.Path, "/")
+
+	if e, ok := existing[path+"/"]; ok {
+		if e.Type != m.Type {
+			return fmt.Errorf("%s%s is already enabled with type %s, not %s", prefix, path, e.Type, m.Type)
+		}
+		return nil
+	}
+
+	request := MountRequest{Type: m.Type, Description: m.Description}
+	if len(m.Options) > 0 {
+		// Vault takes options as strings, while YAML reads version: 2 as a number
+		request.Options = map[string]string{}
+		for k, value := range m.Options {
+			request.Options[k] = fmt.Sprint(value)
+		}
+	}
+
+	method := "POST"
+	if prefix == "/v1/sys/audit/" {
+		method = "PUT"
+	}
+
+	if err := v.request(method, prefix+path, request, nil); err != nil {
+		return fmt.Errorf("%s%s: %s", prefix, path, err)
+	}
+
+	logger.Infof("Enabled %s at %s%s", m.Type, prefix, path)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestBootstrapper(t *testing.T) {
+	spec := `
+revoke_root_token: true
+audit:
+  - path: file
+    type: file
+    options:
+      file_path: /vault/audit/audit.log
+policies:
+  app: |
+    path "secret/data/app/*" {
+      capabilities = ["read"]
+    }
+secrets:
+  - path: secret
+    type: kv
+  - path: apps
+    type: kv
+    options:
+      version: 2
+auth:
+  - path: kubernetes
+    type: kubernetes
+    roles:
+      app:
+        bound_service_account_names: [app]
+        policies: [app]
+`
+
+	var mu sync.Mutex
+	requests := map[string]map[string]interface{}{}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("X-Vault-Token") != "s.root" {
+			w.WriteHeader(403)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{}`))
+		case "/v1/sys/audit", "/v1/sys/auth":
+			w.Write([]byte(`{"data":{}}`))
+		case "/v1/sys/mounts":
+			w.Write([]byte(`{"data":{"secret/":{"type":"kv"}}}`))
+		default:
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			requests[r.Method+" "+r.URL.Path] = body
+			w.WriteHeader(204)
+		}
+	}))
+	defer vault.Close()
+
+	f, err := ioutil.TempFile("", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(spec)
+	f.Close()
+
+	os.Setenv("BOOTSTRAP_CONFIG", f.Name())
+	defer os.Unsetenv("BOOTSTRAP_CONFIG")
+
+	bootstrapper, err := NewBootstrapper(&memoryKeyStore{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrapper.SetRootToken("s.root")
+	bootstrapper.Apply(&VaultClient{Addr: vault.URL})
+
+	for _, expected := range []string{
+		"PUT /v1/sys/audit/file",
+		"PUT /v1/sys/policies/acl/app",
+		"POST /v1/sys/mounts/apps",
+		"POST /v1/sys/auth/kubernetes",
+		"POST /v1/auth/kubernetes/config",
+		"POST /v1/auth/kubernetes/role/app",
+		"POST /v1/auth/token/revoke-self",
+	} {
+		if _, ok := requests[expected]; !ok {
+			t.Errorf("expected %s, got %v", expected, requests)
+		}
+	}
+
+	if _, ok := requests["POST /v1/sys/mounts/secret"]; ok {
+		t.Error("expected the existing secret mount to be left alone")
+	}
+	if options := requests["POST /v1/sys/mounts/apps"]["options"]; options.(map[string]interface{})["version"] != "2" {
+		t.Errorf("expected the kv version to be sent as a string, got %v", options)
+	}
+	if host := requests["POST /v1/auth/kubernetes/config"]["kubernetes_host"]; host != "https://kubernetes.default.svc" {
+		t.Errorf("expected the in-cluster kubernetes host by default, got %v", host)
+	}
+
+	// Applying again within the same process does nothing
+	requests = map[string]map[string]interface{}{}
+	bootstrapper.Apply(&VaultClient{Addr: vault.URL})
+	if len(requests) != 0 {
+		t.Errorf("expected the spec to be applied once, got %v", requests)
+	}
+}
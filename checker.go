@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// vaultChecker brings a Vault server to an unsealed state, shared by the sidecar and the controller
+type vaultChecker struct {
+	store        KeyStore
+	elector      *LeaderElector
+	bootstrapper *Bootstrapper
+	raft         *RaftJoiner
+
+	// initMu makes sure only one server is initialized at a time
+	initMu sync.Mutex
+
+	// states holds the last state of each server
+	states StateMachine
+}
+
+// check - initializes or joins, unseals or bootstraps the Vault server of the named pod depending on its state
+func (c *vaultChecker) check(namespace, name string, vault *VaultClient) {
+	log := vault.log().With(Fields{"pod": name})
+
+	status, err := vault.Status()
+	if err != nil {
+		log.Errorf("Could not read the state of vault: %s", err)
+		return
+	}
+
+	state := status.State()
+	log = log.With(Fields{"state": state})
+	recordState(name, state)
+	podLabeler.Apply(namespace, name, state)
+
+	if previous, changed := c.states.Transition(name, state); changed {
+		if previous == "" {
+			log.Infof("Vault is %s", status)
+		} else {
+			log.Infof("Vault changed from %s to %s", previous, status)
+		}
+		recordTransition(namespace, name, previous, state)
+	}
+
+	switch state {
+	case StateActive:
+		log.Infof("Vault is initialized and unsealed.")
+		c.bootstrapper.Apply(vault)
+	case StateStandby:
+		log.Infof("Vault is unsealed and in standby mode.")
+	case StatePerfStandby:
+		log.Infof("Vault is unsealed and a performance standby.")
+	case StateDRSecondary:
+		log.Infof("Vault is a DR secondary, its keys are managed by the primary cluster.")
+	case StateUninitialized:
+		if c.raft != nil {
+			joined, err := c.raft.Join(vault, c.store)
+			if err != nil {
+				log.Errorf("Could not join the raft cluster: %s", err)
+				return
+			}
+			if joined {
+				log.Infof("Vault joined the raft cluster. Unsealing...")
+				c.unseal(namespace, name, vault)
+				return
+			}
+		}
+
+		c.initMu.Lock()
+		defer c.initMu.Unlock()
+
+		log.Infof("Vault is not initialized. Initializing and unsealing...")
+		if tokens, ok := initializeVault(log, name, vault, c.store, c.elector); ok {
+			events.Normal(namespace, name, ReasonVaultInitialized, "Vault was initialized and its keys stored")
+			c.unseal(namespace, name, vault)
+			c.bootstrapper.SetRootToken(tokens.RootToken)
+		}
+	case StateSealed:
+		log.Infof("Vault is sealed. Unsealing...")
+		c.unseal(namespace, name, vault)
+	}
+}
+
+// unseal - unseals the Vault server of the named pod, logging why if the stored keys could not unseal it
+func (c *vaultChecker) unseal(namespace, name string, vault *VaultClient) {
+	log := vault.log().With(Fields{"pod": name})
+
+	unsealAttempts.WithLabelValues(name).Inc()
+	start := time.Now()
+	err := vault.Unseal(c.store)
+	log = log.With(Fields{"duration": time.Since(start).Round(time.Millisecond)})
+
+	if err != nil {
+		unsealFailures.WithLabelValues(name, failureReason(err)).Inc()
+		recordUnsealFailure(namespace, name, err)
+		log.Errorf("Could not unseal vault: %s", err)
+		return
+	}
+
+	log.Debugf("Unseal complete")
+}
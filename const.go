@@ -6,15 +6,18 @@ import (
 )
 
 var (
-	// NumTokens is the number of tokens created during vault init
+	// NumTokens is the number of tokens created during vault init, set by SECRET_SHARES
 	NumTokens = 5
 
-	// TokensRequired is how many tokens required to unseal
+	// TokensRequired is how many tokens required to unseal, set by SECRET_THRESHOLD
 	TokensRequired = 3
 
 	// vaultSecretName is name of secret in Kubernetes
 	vaultSecretName = "vault-tokens"
 
+	// rootTokenSecretName is the default name of the secret holding the root token
+	rootTokenSecretName = "vault-root-token"
+
 	httpClient = http.Client{
 		Timeout: time.Duration(50 * time.Second),
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Controller watches every Vault pod matching a label selector and unseals the sealed ones
+type Controller struct {
+	// Namespace and Selector find the Vault pods
+	Namespace string
+	Selector  string
+
+	// Scheme and Port are used to reach the Vault server in each pod
+	Scheme string
+	Port   string
+
+	vaultChecker
+}
+
+// NewController - creates a controller from VAULT_NAMESPACE, VAULT_POD_SELECTOR, VAULT_POD_SCHEME and VAULT_POD_PORT
+func NewController(store KeyStore, elector *LeaderElector, bootstrapper *Bootstrapper, raft *RaftJoiner) (*Controller, error) {
+	c := &Controller{
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Selector:  os.Getenv("VAULT_POD_SELECTOR"),
+		Scheme:    os.Getenv("VAULT_POD_SCHEME"),
+		Port:      os.Getenv("VAULT_POD_PORT"),
+		vaultChecker: vaultChecker{
+			store:        store,
+			elector:      elector,
+			bootstrapper: bootstrapper,
+			raft:         raft,
+		},
+	}
+
+	if c.Namespace == "" {
+		c.Namespace = kubeClient.Namespace
+	}
+
+	if c.Selector == "" {
+		c.Selector = "app=vault"
+	}
+
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return nil, fmt.Errorf("VAULT_POD_SCHEME must be http or https")
+	}
+
+	if c.Port == "" {
+		c.Port = "8200"
+	}
+
+	return c, nil
+}
+
+// Check - polls every running Vault pod concurrently, unsealing sealed pods
+func (c *Controller) Check() {
+	pods, err := c.Pods()
+	if err != nil {
+		logger.Errorf("Could not list Vault pods: %s", err)
+		return
+	}
+
+	if len(pods) == 0 {
+		logger.Warnf("No running pods match %q in namespace %s", c.Selector, c.Namespace)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod Pod) {
+			defer wg.Done()
+			c.checkPod(pod)
+		}(pod)
+	}
+	wg.Wait()
+}
+
+// Pods - lists the running pods matching the selector
+func (c *Controller) Pods() ([]Pod, error) {
+	res, err := kubernetesRequest("GET", "/api/v1/namespaces/"+c.Namespace+"/pods?labelSelector="+url.QueryEscape(c.Selector), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	k8sResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("list pods: non 200 status code: %d", res.StatusCode)
+	}
+
+	list := PodList{}
+	if err := json.Unmarshal(k8sResponse, &list); err != nil {
+		return nil, fmt.Errorf("list pods: %s", err)
+	}
+
+	var pods []Pod
+	for _, pod := range list.Items {
+		if pod.Status.Phase == "Running" && pod.Status.PodIP != "" {
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// Reachable - returns an error unless the Vault server in at least one running pod answers
+func (c *Controller) Reachable() error {
+	pods, err := c.Pods()
+	if err != nil {
+		return err
+	}
+
+	if len(pods) == 0 {
+		return fmt.Errorf("no running pods match %q in namespace %s", c.Selector, c.Namespace)
+	}
+
+	for _, pod := range pods {
+		if _, err := c.vault(pod).Status(); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("none of the %d Vault pods answered", len(pods))
+}
+
+// vault - returns a client for the Vault server in pod
+func (c *Controller) vault(pod Pod) *VaultClient {
+	return &VaultClient{Addr: c.Scheme + "://" + pod.Status.PodIP + ":" + c.Port}
+}
+
+// checkPod - checks the Vault server in pod
+func (c *Controller) checkPod(pod Pod) {
+	name := pod.Metadata.Name
+	vault := c.vault(pod)
+
+	// A failure on one pod must not stop the others from being unsealed
+	defer func() {
+		if r := recover(); r != nil {
+			vault.log().With(Fields{"pod": name}).Errorf("Check failed: %v", r)
+		}
+	}()
+
+	c.check(c.Namespace, name, vault)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault is a shamir sealed vault server that accepts keys and initializes once
+type fakeVault struct {
+	sync.Mutex
+	name        string
+	initialized bool
+	sealed      bool
+	keys        []string
+	progress    int
+	inits       int
+	submitted   int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/sys/health":
+		json.NewEncoder(w).Encode(HealthResponse{Initialized: f.initialized, Sealed: f.sealed, Version: "1.4.2"})
+	case "/v1/sys/seal-status":
+		json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Initialized: f.initialized, Sealed: f.sealed, T: TokensRequired, N: NumTokens, Progress: f.progress, Version: "1.4.2"})
+	case "/v1/sys/init":
+		// Give a racing check time to start a second initialization
+		time.Sleep(50 * time.Millisecond)
+		f.inits++
+		f.initialized, f.sealed = true, true
+		f.keys = nil
+		for i := 1; i <= NumTokens; i++ {
+			f.keys = append(f.keys, fmt.Sprintf("%s-key%d", f.name, i))
+		}
+		json.NewEncoder(w).Encode(VaultToken{RootToken: "s." + f.name, Tokens: f.keys})
+	case "/v1/sys/unseal":
+		var req UnsealRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.submitted++
+		if req.Reset {
+			f.progress = 0
+		} else if f.accepts(req.Key) {
+			f.progress++
+		} else {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(VaultError{Errors: []string{"invalid key"}})
+			return
+		}
+		if f.progress >= TokensRequired {
+			f.sealed, f.progress = false, 0
+		}
+		json.NewEncoder(w).Encode(UnsealResponse{Sealed: f.sealed, T: TokensRequired, N: NumTokens, Progress: f.progress})
+	}
+}
+
+// accepts - reports whether key is one of the keys vault was initialized with
+func (f *fakeVault) accepts(key string) bool {
+	for _, k := range f.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestController - serves each vault on its own loopback address and the same port, lists them as running pods and returns a controller for them
+func newTestController(t *testing.T, fake *fakeKubernetes, store KeyStore, vaults ...*fakeVault) (*Controller, func()) {
+	var port string
+	var items []interface{}
+	var servers []*httptest.Server
+	closeAll := func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+
+	for i, vault := range vaults {
+		ip := fmt.Sprintf("127.0.0.%d", i+1)
+		addr := ip + ":0"
+		if port != "" {
+			addr = ip + ":" + port
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			t.Skipf("could not listen on %s: %s", addr, err)
+		}
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+
+		server := httptest.NewUnstartedServer(vault)
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		servers = append(servers, server)
+
+		items = append(items, map[string]interface{}{
+			"metadata": map[string]interface{}{"name": vault.name},
+			"status":   map[string]interface{}{"phase": "Running", "podIP": ip},
+		})
+	}
+
+	fake.objects["/api/v1/namespaces/vault/pods"] = map[string]interface{}{"items": items}
+
+	return &Controller{Namespace: "vault", Selector: "app=vault", Scheme: "http", Port: port, vaultChecker: vaultChecker{store: store}}, closeAll
+}
+
+func TestControllerInitializesOnePod(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	store := &memoryKeyStore{}
+	vault0 := &fakeVault{name: "vault-0", sealed: true}
+	vault1 := &fakeVault{name: "vault-1", sealed: true}
+	c, closeVaults := newTestController(t, fake, store, vault0, vault1)
+	defer closeVaults()
+
+	c.Check()
+
+	if vault0.inits+vault1.inits != 1 {
+		t.Fatalf("expected exactly one pod to be initialized, got %d and %d", vault0.inits, vault1.inits)
+	}
+
+	initialized, other := vault0, vault1
+	if vault1.inits == 1 {
+		initialized, other = vault1, vault0
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.RootToken != "s."+initialized.name || strings.Join(tokens.Tokens, ",") != strings.Join(initialized.keys, ",") {
+		t.Fatalf("expected the keys of %s to be stored, got %+v", initialized.name, tokens)
+	}
+	if initialized.sealed {
+		t.Fatalf("expected %s to be unsealed after initializing", initialized.name)
+	}
+	if other.initialized || other.submitted != 0 {
+		t.Fatalf("expected %s to be left alone once keys were stored, got %+v", other.name, other)
+	}
+
+	// The next check still refuses to initialize a second cluster
+	c.Check()
+	if other.inits != 0 {
+		t.Fatalf("expected %s not to be initialized with keys stored", other.name)
+	}
+}
+
+func TestControllerUnsealsSealedPods(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	keys := []string{"key1", "key2", "key3", "key4", "key5"}
+	store := &memoryKeyStore{}
+	store.Save(VaultToken{RootToken: "s.root", Tokens: keys})
+
+	active := &fakeVault{name: "vault-0", initialized: true, keys: keys}
+	sealed := &fakeVault{name: "vault-1", initialized: true, sealed: true, keys: keys, progress: 1}
+	c, closeVaults := newTestController(t, fake, store, active, sealed)
+	defer closeVaults()
+
+	c.Check()
+
+	if active.inits+sealed.inits != 0 {
+		t.Fatal("expected no pod to be initialized")
+	}
+	if active.submitted != 0 {
+		t.Fatalf("expected no keys to be sent to the unsealed pod, got %d", active.submitted)
+	}
+	if sealed.sealed {
+		t.Fatal("expected the sealed pod to be unsealed")
+	}
+	// One reset for the progress left behind, then the threshold
+	if sealed.submitted != TokensRequired+1 {
+		t.Fatalf("expected %d unseal requests, got %d", TokensRequired+1, sealed.submitted)
+	}
+}
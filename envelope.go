@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+const (
+	// envelopePrefix marks a stored value as envelope encrypted
+	envelopePrefix = "vault-init:"
+
+	// envelopeVersion is the version of the envelope format written by Encrypt
+	envelopeVersion = 1
+)
+
+// KeyWrapper wraps the data keys of an envelope with a key-encryption key
+type KeyWrapper interface {
+	// ID identifies the key-encryption key so envelopes can be matched to it after rotation
+	ID() string
+
+	// Wrap encrypts a data key
+	Wrap(dataKey []byte) ([]byte, error)
+
+	// Unwrap decrypts a data key returned by Wrap
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// envelope is the versioned format of an encrypted value
+type envelope struct {
+	Version    int    `json:"v"`
+	KeyID      string `json:"kid"`
+	DataKey    []byte `json:"dk"`
+	Nonce      []byte `json:"n"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// EncryptedKeyStore envelope encrypts tokens before handing them to another key store
+type EncryptedKeyStore struct {
+	KeyStore
+
+	// AllowPlaintext reads values stored before encryption was enabled as they are, for migrating to encryption only
+	AllowPlaintext bool
+
+	wrapper KeyWrapper
+
+	// previous are retired key-encryption keys, only used to decrypt values written before a rotation
+	previous []KeyWrapper
+}
+
+// NewEncryptedKeyStore - wraps store so every token is encrypted with a fresh AES-256-GCM data key,
+// decrypting values wrapped by the previous key-encryption keys as well
+func NewEncryptedKeyStore(store KeyStore, wrapper KeyWrapper, previous ...KeyWrapper) *EncryptedKeyStore {
+	return &EncryptedKeyStore{
+		KeyStore: store,
+		wrapper:  wrapper,
+		previous: previous,
+	}
+}
+
+// Save - encrypts the root token, unseal, recovery and retired keys then saves them,
+// keeping the stored envelope of any value that did not change so saving the same keys again leaves them as they are
+func (s *EncryptedKeyStore) Save(tokens VaultToken) error {
+	stored, err := s.storedEnvelopes()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := s.encryptTokens(tokens, stored)
+	if err != nil {
+		return err
+	}
+
+	return s.KeyStore.Save(encrypted)
+}
+
+// Rotate - encrypts tokens then replaces the stored keys with them, keeping a backup under version
+func (s *EncryptedKeyStore) Rotate(tokens VaultToken, version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := s.encryptTokens(tokens, nil)
+	if err != nil {
+		return err
+	}
+
+	return rotator.Rotate(encrypted, version)
+}
+
+// Restore - puts the keys backed up under version back in place
+func (s *EncryptedKeyStore) Restore(version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+	return rotator.Restore(version)
+}
+
+// DeleteBackup - removes the keys backed up under version
+func (s *EncryptedKeyStore) DeleteBackup(version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+	return rotator.DeleteBackup(version)
+}
+
+// Load - loads the root token, unseal, recovery and retired keys then decrypts them
+func (s *EncryptedKeyStore) Load() (VaultToken, error) {
+	encrypted, err := s.KeyStore.Load()
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	tokens := VaultToken{}
+
+	tokens.RootToken, err = s.Decrypt(encrypted.RootToken)
+	if err != nil {
+		return VaultToken{}, fmt.Errorf("could not decrypt root token: %s", err)
+	}
+
+	if tokens.Tokens, err = s.decryptAll("key", encrypted.Tokens); err != nil {
+		return VaultToken{}, err
+	}
+
+	if tokens.RecoveryKeys, err = s.decryptAll("recovery-key", encrypted.RecoveryKeys); err != nil {
+		return VaultToken{}, err
+	}
+
+	if tokens.RetiredKeys, err = s.decryptAll("retired-key", encrypted.RetiredKeys); err != nil {
+		return VaultToken{}, err
+	}
+
+	return tokens, nil
+}
+
+// SaveRootToken - encrypts token then stores it in place of the current root token
+func (s *EncryptedKeyStore) SaveRootToken(token string) error {
+	rootStore, err := rootTokenStore(s.KeyStore)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := s.Encrypt(token)
+	if err != nil {
+		return err
+	}
+
+	return rootStore.SaveRootToken(encrypted)
+}
+
+// LoadRootToken - loads the root token then decrypts it
+func (s *EncryptedKeyStore) LoadRootToken() (string, error) {
+	rootStore, err := rootTokenStore(s.KeyStore)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := rootStore.LoadRootToken()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := s.Decrypt(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt root token: %s", err)
+	}
+
+	return token, nil
+}
+
+// encryptTokens - encrypts the root token, unseal, recovery and retired keys of tokens, reusing the envelopes in stored
+func (s *EncryptedKeyStore) encryptTokens(tokens VaultToken, stored map[string]string) (VaultToken, error) {
+	var err error
+	encrypted := VaultToken{VaultVersion: tokens.VaultVersion}
+
+	encrypted.RootToken, err = s.encryptOrReuse(tokens.RootToken, stored)
+	if err != nil {
+		return encrypted, err
+	}
+
+	if encrypted.Tokens, err = s.encryptAll(tokens.Tokens, stored); err != nil {
+		return encrypted, err
+	}
+
+	if encrypted.RecoveryKeys, err = s.encryptAll(tokens.RecoveryKeys, stored); err != nil {
+		return encrypted, err
+	}
+
+	encrypted.RetiredKeys, err = s.encryptAll(tokens.RetiredKeys, stored)
+	return encrypted, err
+}
+
+// encryptAll - encrypts each of keys, reusing the envelopes in stored
+func (s *EncryptedKeyStore) encryptAll(keys []string, stored map[string]string) ([]string, error) {
+	var encrypted []string
+
+	for _, key := range keys {
+		k, err := s.encryptOrReuse(key, stored)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, k)
+	}
+
+	return encrypted, nil
+}
+
+// encryptOrReuse - returns the stored envelope of plaintext if there is one, otherwise encrypts it
+func (s *EncryptedKeyStore) encryptOrReuse(plaintext string, stored map[string]string) (string, error) {
+	if e, ok := stored[plaintext]; ok && plaintext != "" {
+		return e, nil
+	}
+	return s.Encrypt(plaintext)
+}
+
+// storedEnvelopes - maps the stored values encrypted with the current key-encryption key to their envelopes,
+// leaving out values that are stored in plaintext or under a previous key so those are encrypted again
+func (s *EncryptedKeyStore) storedEnvelopes() (map[string]string, error) {
+	exists, err := s.KeyStore.Exists()
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	encrypted, err := s.KeyStore.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{encrypted.RootToken}
+	if rootStore, ok := s.KeyStore.(RootTokenStore); ok {
+		// A missing root token only means there is nothing to reuse
+		if rootToken, err := rootStore.LoadRootToken(); err == nil {
+			values = append(values, rootToken)
+		}
+	}
+	values = append(values, encrypted.Tokens...)
+	values = append(values, encrypted.RecoveryKeys...)
+	values = append(values, encrypted.RetiredKeys...)
+
+	stored := map[string]string{}
+	for _, value := range values {
+		if envelopeKeyID(value) != s.wrapper.ID() {
+			continue
+		}
+
+		plaintext, err := s.Decrypt(value)
+		if err != nil {
+			return nil, err
+		}
+		stored[plaintext] = value
+	}
+
+	return stored, nil
+}
+
+// decryptAll - decrypts each of keys, naming the failing key as prefix followed by its number
+func (s *EncryptedKeyStore) decryptAll(prefix string, keys []string) ([]string, error) {
+	var decrypted []string
+
+	for i, key := range keys {
+		k, err := s.Decrypt(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s%d: %s", prefix, i+1, err)
+		}
+		decrypted = append(decrypted, k)
+	}
+
+	return decrypted, nil
+}
+
+// Encrypt - seals plaintext with a new data key and returns the encoded envelope
+func (s *EncryptedKeyStore) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	nonce, ciphertext, err := sealAESGCM(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := s.wrapper.Wrap(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("could not wrap data key: %s", err)
+	}
+
+	e := envelope{
+		Version:    envelopeVersion,
+		KeyID:      s.wrapper.ID(),
+		DataKey:    wrapped,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}
+
+	b := toJSON(e)
+	return envelopePrefix + base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// Decrypt - opens an envelope returned by Encrypt with the current or a previous key-encryption key,
+// refusing values stored without encryption unless AllowPlaintext is set
+func (s *EncryptedKeyStore) Decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(value, envelopePrefix) {
+		if !s.AllowPlaintext {
+			return "", errors.New("value is not envelope encrypted, set ENCRYPTION_ALLOW_PLAINTEXT to read keys stored before encryption was enabled")
+		}
+		envelopeReads.WithLabelValues("plaintext").Inc()
+		logger.Warnf("Read a value stored without envelope encryption, it is encrypted the next time the keys are saved")
+		return value, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, envelopePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return "", err
+	}
+
+	if e.Version != envelopeVersion {
+		return "", fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+
+	wrapper := s.wrapperFor(e.KeyID)
+	if wrapper == nil {
+		return "", fmt.Errorf("envelope was encrypted with key %q but the configured key is %q and no previous key matches", e.KeyID, s.wrapper.ID())
+	}
+
+	if wrapper == s.wrapper {
+		envelopeReads.WithLabelValues("current").Inc()
+	} else {
+		envelopeReads.WithLabelValues("previous").Inc()
+		logger.Warnf("Decrypted a value with the previous key-encryption key %s, it is encrypted with %s the next time the keys are saved", e.KeyID, s.wrapper.ID())
+	}
+
+	dataKey, err := wrapper.Unwrap(e.DataKey)
+	if err != nil {
+		return "", fmt.Errorf("could not unwrap data key: %s", err)
+	}
+
+	plaintext, err := openAESGCM(dataKey, e.Nonce, e.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// envelopeKeyID - returns the ID of the key-encryption key an envelope was encrypted with, or "" if value is not an envelope
+func envelopeKeyID(value string) string {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return ""
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, envelopePrefix))
+	if err != nil {
+		return ""
+	}
+
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return ""
+	}
+
+	return e.KeyID
+}
+
+// wrapperFor - returns the current or previous key-encryption key with the given ID, or nil if none is configured
+func (s *EncryptedKeyStore) wrapperFor(id string) KeyWrapper {
+	if s.wrapper.ID() == id {
+		return s.wrapper
+	}
+
+	for _, w := range s.previous {
+		if w.ID() == id {
+			return w
+		}
+	}
+
+	return nil
+}
+
+// FileKeyWrapper wraps data keys with a 256 bit key read from a file
+type FileKeyWrapper struct {
+	key []byte
+}
+
+// NewFileKeyWrapper - reads a raw or base64 encoded 32 byte key-encryption key from path
+func NewFileKeyWrapper(path string) (*FileKeyWrapper, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := b
+	if len(key) != 32 {
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must contain a 32 byte key, raw or base64 encoded", path)
+		}
+	}
+
+	return &FileKeyWrapper{key: key}, nil
+}
+
+// ID - identifies the key by the start of its SHA-256 fingerprint
+func (w *FileKeyWrapper) ID() string {
+	sum := sha256.Sum256(w.key)
+	return "file:" + hex.EncodeToString(sum[:8])
+}
+
+// Wrap - encrypts the data key with AES-256-GCM
+func (w *FileKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	nonce, ciphertext, err := sealAESGCM(w.key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+// Unwrap - decrypts a data key returned by Wrap
+func (w *FileKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 12 {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return openAESGCM(w.key, wrapped[:12], wrapped[12:])
+}
+
+// KMSKeyWrapper wraps data keys with a Cloud KMS key
+type KMSKeyWrapper struct {
+	ctx   context.Context
+	kms   *cloudkms.Service
+	keyID string
+}
+
+// NewKMSKeyWrapper - creates a wrapper for the given Cloud KMS key using the default Google credentials
+func NewKMSKeyWrapper(keyID string) (*KMSKeyWrapper, error) {
+	ctx := context.Background()
+	kms, err := newKMSService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KMSKeyWrapper{
+		ctx:   ctx,
+		kms:   kms,
+		keyID: keyID,
+	}, nil
+}
+
+// ID - identifies the key by its resource name
+func (w *KMSKeyWrapper) ID() string {
+	return "kms:" + w.keyID
+}
+
+// Wrap - encrypts the data key with Cloud KMS
+func (w *KMSKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	return kmsEncrypt(w.ctx, w.kms, w.keyID, dataKey)
+}
+
+// Unwrap - decrypts a data key with Cloud KMS
+func (w *KMSKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	return kmsDecrypt(w.ctx, w.kms, w.keyID, wrapped)
+}
+
+// NewKeyWrapper - creates the key-encryption key wrapper from ENCRYPTION_KEY_FILE or ENCRYPTION_KMS_KEY_ID, returning nil if neither is set
+func NewKeyWrapper() (KeyWrapper, error) {
+	keyFile := os.Getenv("ENCRYPTION_KEY_FILE")
+	kmsKeyID := os.Getenv("ENCRYPTION_KMS_KEY_ID")
+
+	switch {
+	case keyFile != "" && kmsKeyID != "":
+		return nil, errors.New("only one of ENCRYPTION_KEY_FILE and ENCRYPTION_KMS_KEY_ID may be set")
+	case keyFile != "":
+		return NewFileKeyWrapper(keyFile)
+	case kmsKeyID != "":
+		return NewKMSKeyWrapper(kmsKeyID)
+	}
+
+	return nil, nil
+}
+
+// NewPreviousKeyWrappers - creates decrypt-only wrappers for the retired key-encryption keys in the comma separated
+// ENCRYPTION_PREVIOUS_KEY_FILES and ENCRYPTION_PREVIOUS_KMS_KEY_IDS
+func NewPreviousKeyWrappers() ([]KeyWrapper, error) {
+	var wrappers []KeyWrapper
+
+	for _, path := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_KEY_FILES"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		w, err := NewFileKeyWrapper(path)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_PREVIOUS_KEY_FILES is invalid: %s", err)
+		}
+		wrappers = append(wrappers, w)
+	}
+
+	for _, keyID := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_KMS_KEY_IDS"), ",") {
+		if keyID = strings.TrimSpace(keyID); keyID == "" {
+			continue
+		}
+
+		w, err := NewKMSKeyWrapper(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_PREVIOUS_KMS_KEY_IDS is invalid: %s", err)
+		}
+		wrappers = append(wrappers, w)
+	}
+
+	return wrappers, nil
+}
+
+// allowPlaintext - reads ENCRYPTION_ALLOW_PLAINTEXT, which lets keys stored before encryption was enabled be read during the migration
+func allowPlaintext() (bool, error) {
+	v := os.Getenv("ENCRYPTION_ALLOW_PLAINTEXT")
+	if v == "" {
+		return false, nil
+	}
+
+	allow, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("ENCRYPTION_ALLOW_PLAINTEXT is invalid: %s", err)
+	}
+	return allow, nil
+}
+
+// sealAESGCM - encrypts plaintext with AES-GCM under a random nonce
+func sealAESGCM(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+// openAESGCM - decrypts ciphertext produced by sealAESGCM
+func openAESGCM(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestFileKeyWrapper(t *testing.T, key string) *FileKeyWrapper {
+	f, err := ioutil.TempFile("", "kek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(base64.StdEncoding.EncodeToString([]byte(key)) + "\n")
+	f.Close()
+
+	wrapper, err := NewFileKeyWrapper(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+func TestEncryptedKeyStore(t *testing.T) {
+	backend := &memoryKeyStore{}
+	store := NewEncryptedKeyStore(backend, newTestFileKeyWrapper(t, "0123456789abcdef0123456789abcdef"))
+
+	tokens := VaultToken{
+		RootToken: "s.root",
+		Tokens:    []string{"key-a", "key-b"},
+	}
+	if err := store.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range append([]string{backend.tokens.RootToken}, backend.tokens.Tokens...) {
+		if !strings.HasPrefix(v, envelopePrefix) || strings.Contains(v, "s.root") || strings.Contains(v, "key-") {
+			t.Fatalf("expected an envelope, got %q", v)
+		}
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "s.root" || strings.Join(loaded.Tokens, ",") != "key-a,key-b" {
+		t.Fatalf("loaded %+v, expected %+v", loaded, tokens)
+	}
+
+	rotated := NewEncryptedKeyStore(backend, newTestFileKeyWrapper(t, "fedcba9876543210fedcba9876543210"))
+	if _, err := rotated.Load(); err == nil || !strings.Contains(err.Error(), "configured key") {
+		t.Fatalf("expected a key mismatch error, got %v", err)
+	}
+}
+
+func TestEncryptedKeyStoreRotation(t *testing.T) {
+	backend := &memoryKeyStore{}
+	old := newTestFileKeyWrapper(t, "0123456789abcdef0123456789abcdef")
+	if err := NewEncryptedKeyStore(backend, old).Save(VaultToken{RootToken: "s.root", Tokens: []string{"key-a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	current := newTestFileKeyWrapper(t, "fedcba9876543210fedcba9876543210")
+	store := NewEncryptedKeyStore(backend, current, old)
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "s.root" || loaded.Tokens[0] != "key-a" {
+		t.Fatalf("expected the previous key to decrypt the stored values, got %+v", loaded)
+	}
+
+	// Saving again moves the values to the current key, so the previous one can be dropped
+	if err := store.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncryptedKeyStore(backend, current).Load(); err != nil {
+		t.Fatalf("expected the values to be encrypted with the current key, got %v", err)
+	}
+}
+
+func TestEncryptedKeyStorePlaintext(t *testing.T) {
+	backend := &memoryKeyStore{tokens: &VaultToken{RootToken: "s.root", Tokens: []string{"key-a"}}}
+	store := NewEncryptedKeyStore(backend, newTestFileKeyWrapper(t, "0123456789abcdef0123456789abcdef"))
+
+	if _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "ENCRYPTION_ALLOW_PLAINTEXT") {
+		t.Fatalf("expected plaintext values to be refused, got %v", err)
+	}
+
+	store.AllowPlaintext = true
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "s.root" || loaded.Tokens[0] != "key-a" {
+		t.Fatalf("expected plaintext values to pass through, got %+v", loaded)
+	}
+
+	// An empty root token is not a plaintext value
+	backend.tokens.RootToken = ""
+	store.AllowPlaintext = false
+	backend.tokens.Tokens = nil
+	if _, err := store.Load(); err != nil {
+		t.Fatalf("expected an empty root token to be read, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event reasons reported against Vault pods
+const (
+	ReasonVaultInitialized    = "VaultInitialized"
+	ReasonVaultUnsealed       = "VaultUnsealed"
+	ReasonVaultSealedDetected = "VaultSealedDetected"
+	ReasonUnsealFailed        = "UnsealFailed"
+	ReasonKeyStoreUnavailable = "KeyStoreUnavailable"
+)
+
+// eventComponent is the source of every event
+const eventComponent = "vault-init"
+
+// events reports what vault-init does to the Vault pods, nil when EVENTS is false
+var events *EventRecorder
+
+// EventRecorder posts Kubernetes events against pods, counting repeats of the same event instead of creating new ones
+type EventRecorder struct {
+	// Instance identifies this replica of vault-init, normally the pod name
+	Instance string
+
+	mu     sync.Mutex
+	uids   map[string]string
+	recent map[string]Event
+}
+
+// NewEventRecorder - creates a recorder reporting as POD_NAME, returning nil if EVENTS is false
+func NewEventRecorder() (*EventRecorder, error) {
+	if v := os.Getenv("EVENTS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("EVENTS is invalid: %s", err)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	r := &EventRecorder{
+		Instance: os.Getenv("POD_NAME"),
+		uids:     map[string]string{},
+		recent:   map[string]Event{},
+	}
+
+	if r.Instance == "" {
+		r.Instance, _ = os.Hostname()
+	}
+
+	return r, nil
+}
+
+// Normal - reports an informational event against the pod
+func (r *EventRecorder) Normal(namespace, pod, reason, message string) {
+	r.record(namespace, pod, "Normal", reason, message)
+}
+
+// Warning - reports a problem against the pod
+func (r *EventRecorder) Warning(namespace, pod, reason, message string) {
+	r.record(namespace, pod, "Warning", reason, message)
+}
+
+// record - posts the event, or bumps the count of the same event posted earlier, logging rather than returning failures
+func (r *EventRecorder) record(namespace, pod, eventType, reason, message string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	key := namespace + "/" + pod + "/" + eventType + "/" + reason + "/" + message
+
+	if event, ok := r.recent[key]; ok {
+		event.Count++
+		event.LastTimestamp = now
+		if updated, err := r.send("PUT", event); err == nil {
+			r.recent[key] = updated
+			return
+		}
+		// The event expired or was changed, so start a new one
+		delete(r.recent, key)
+	}
+
+	uid, err := r.podUID(namespace, pod)
+	if err != nil {
+		logger.Warnf("Could not report %s for pod %s: %s", reason, pod, err)
+		return
+	}
+
+	event := Event{
+		Kind:       "Event",
+		APIVersion: "v1",
+		Metadata: MetaData{
+			Name:      fmt.Sprintf("%s.%x", pod, time.Now().UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       pod,
+			UID:        uid,
+		},
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             EventSource{Component: eventComponent},
+		FirstTimestamp:     now,
+		LastTimestamp:      now,
+		Count:              1,
+		ReportingComponent: eventComponent,
+		ReportingInstance:  r.Instance,
+	}
+
+	created, err := r.send("POST", event)
+	if err != nil {
+		logger.Warnf("Could not report %s for pod %s: %s", reason, pod, err)
+		return
+	}
+
+	r.recent[key] = created
+}
+
+// send - creates or replaces event, returning it as stored
+func (r *EventRecorder) send(method string, event Event) (Event, error) {
+	url := "/api/v1/namespaces/" + event.Metadata.Namespace + "/events"
+	if method == "PUT" {
+		url += "/" + event.Metadata.Name
+	}
+
+	b := toJSON(event)
+	res, err := kubernetesRequest(method, url, &b)
+	if err != nil {
+		return event, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return event, err
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return event, fmt.Errorf("%s event: non 2xx status code: %d", method, res.StatusCode)
+	}
+
+	stored := Event{}
+	if err := json.Unmarshal(body, &stored); err != nil {
+		return event, err
+	}
+
+	return stored, nil
+}
+
+// podUID - returns the UID of the pod, which kubectl describe matches events on
+func (r *EventRecorder) podUID(namespace, name string) (string, error) {
+	key := namespace + "/" + name
+	if uid, ok := r.uids[key]; ok {
+		return uid, nil
+	}
+
+	res, err := kubernetesRequest("GET", "/api/v1/namespaces/"+namespace+"/pods/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("get pod %s: non 200 status code: %d", name, res.StatusCode)
+	}
+
+	pod := Pod{}
+	if err := json.Unmarshal(body, &pod); err != nil {
+		return "", err
+	}
+
+	r.uids[key] = pod.Metadata.UID
+	return pod.Metadata.UID, nil
+}
+
+// recordTransition - reports the pod becoming sealed, or unsealed again
+func recordTransition(namespace, pod string, previous, state VaultState) {
+	switch {
+	case state == StateSealed:
+		events.Warning(namespace, pod, ReasonVaultSealedDetected, "Vault is sealed")
+	case previous == StateSealed && state != StateUninitialized:
+		events.Normal(namespace, pod, ReasonVaultUnsealed, "Vault is unsealed and "+string(state))
+	}
+}
+
+// recordUnsealFailure - reports why the pod could not be unsealed, separating key store problems from vault rejecting the keys
+func recordUnsealFailure(namespace, pod string, err error) {
+	switch failureReason(err) {
+	case "key_store", "load_keys":
+		events.Warning(namespace, pod, ReasonKeyStoreUnavailable, err.Error())
+	default:
+		events.Warning(namespace, pod, ReasonUnsealFailed, err.Error())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEventRecorder(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	fake.objects["/api/v1/namespaces/vault/pods/vault-0"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "vault-0", "uid": "uid-0"},
+	}
+
+	recorder, err := NewEventRecorder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previous *EventRecorder) { events = previous }(events)
+	events = recorder
+
+	unsealErr := failure{"keys_rejected", errors.New("vault is still sealed")}
+	recordUnsealFailure("vault", "vault-0", unsealErr)
+	recordUnsealFailure("vault", "vault-0", unsealErr)
+	recordUnsealFailure("vault", "vault-0", failure{"load_keys", errors.New("could not load unseal keys")})
+
+	paths := fake.list("/api/v1/namespaces/vault/events/")
+	if len(paths) != 2 {
+		t.Fatalf("expected the repeated failure to be counted on one event, got %v", paths)
+	}
+
+	counts := map[string]float64{}
+	for _, path := range paths {
+		event := fake.get(path)
+		involved := event["involvedObject"].(map[string]interface{})
+		if involved["name"] != "vault-0" || involved["uid"] != "uid-0" || involved["kind"] != "Pod" {
+			t.Fatalf("expected the event to be against pod vault-0, got %v", involved)
+		}
+		if event["type"] != "Warning" {
+			t.Fatalf("expected a warning, got %v", event["type"])
+		}
+		counts[event["reason"].(string)] = event["count"].(float64)
+	}
+
+	if counts[ReasonUnsealFailed] != 2 || counts[ReasonKeyStoreUnavailable] != 1 {
+		t.Fatalf("expected UnsealFailed twice and KeyStoreUnavailable once, got %v", counts)
+	}
+}
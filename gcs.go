@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// gcsCurrentObject names the generation prefix the current keys are stored under
+	gcsCurrentObject = "current"
+
+	// gcsRootTokenObject is the object holding the encrypted root token
+	gcsRootTokenObject = "root-token.enc"
+
+	// gcsUnsealKeyObject is the format of the objects holding each encrypted unseal key
+	gcsUnsealKeyObject = "unseal-key-%d.enc"
+
+	// gcsRecoveryKeyObject is the format of the objects holding each encrypted recovery key
+	gcsRecoveryKeyObject = "recovery-key-%d.enc"
+
+	// gcsRetiredKeyObject is the format of the objects holding each key retired by a seal migration
+	gcsRetiredKeyObject = "retired-key-%d.enc"
+)
+
+// GCSKeyStore stores the root token and unseal keys in a Google Cloud Storage bucket, encrypted with Cloud KMS
+type GCSKeyStore struct {
+	ctx      context.Context
+	bucket   *storage.BucketHandle
+	kms      *cloudkms.Service
+	kmsKeyID string
+}
+
+// NewGCSKeyStore - creates a key store from GCS_BUCKET_NAME and KMS_KEY_ID using the default Google credentials
+func NewGCSKeyStore() (KeyStore, error) {
+	bucketName := os.Getenv("GCS_BUCKET_NAME")
+	if bucketName == "" {
+		return nil, errors.New("GCS_BUCKET_NAME must be set")
+	}
+
+	kmsKeyID := os.Getenv("KMS_KEY_ID")
+	if kmsKeyID == "" {
+		return nil, errors.New("KMS_KEY_ID must be set")
+	}
+
+	ctx := context.Background()
+	client, err := google.DefaultClient(ctx, cloudkms.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not create google client: %s", err)
+	}
+
+	return newGCSKeyStore(ctx, client, bucketName, kmsKeyID)
+}
+
+// newGCSKeyStore - creates a key store using the given authenticated client
+func newGCSKeyStore(ctx context.Context, client *http.Client, bucketName, kmsKeyID string) (*GCSKeyStore, error) {
+	storageClient, err := storage.NewClient(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not create storage client: %s", err)
+	}
+
+	kmsService, err := cloudkms.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not create kms client: %s", err)
+	}
+
+	return &GCSKeyStore{
+		ctx:      ctx,
+		bucket:   storageClient.Bucket(bucketName),
+		kms:      kmsService,
+		kmsKeyID: kmsKeyID,
+	}, nil
+}
+
+// Save - encrypts the root token, when there is one, and each unseal, recovery or retired key with KMS,
+// writing them as a new generation that replaces the stored keys only once every object is written
+func (s *GCSKeyStore) Save(tokens VaultToken) error {
+	return s.replace(func(prefix string) error {
+		if tokens.RootToken != "" {
+			if err := s.write(prefix+gcsRootTokenObject, tokens.RootToken); err != nil {
+				return err
+			}
+		}
+
+		for format, keys := range map[string][]string{
+			gcsUnsealKeyObject:   tokens.Tokens,
+			gcsRecoveryKeyObject: tokens.RecoveryKeys,
+			gcsRetiredKeyObject:  tokens.RetiredKeys,
+		} {
+			for i, key := range keys {
+				if err := s.write(prefix+fmt.Sprintf(format, i+1), key); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Load - reads the root token, unseal, recovery and retired keys of the current generation and decrypts them with KMS,
+// leaving the root token empty when none is stored
+func (s *GCSKeyStore) Load() (VaultToken, error) {
+	var tokens VaultToken
+
+	prefix, err := s.currentPrefix()
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	tokens.RootToken, err = s.read(prefix + gcsRootTokenObject)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return VaultToken{}, err
+	}
+
+	tokens.Tokens, err = s.readAll(prefix + gcsUnsealKeyObject)
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	tokens.RecoveryKeys, err = s.readAll(prefix + gcsRecoveryKeyObject)
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	tokens.RetiredKeys, err = s.readAll(prefix + gcsRetiredKeyObject)
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	return tokens, nil
+}
+
+// SaveRootToken - encrypts the root token with KMS and writes it with a copy of the stored keys as a new generation, or drops it when token is empty
+func (s *GCSKeyStore) SaveRootToken(token string) error {
+	current, err := s.currentPrefix()
+	if err != nil {
+		return err
+	}
+
+	return s.replace(func(prefix string) error {
+		if err := s.copyObjects(current, prefix); err != nil {
+			return err
+		}
+
+		if token == "" {
+			return s.deleteObject(prefix + gcsRootTokenObject)
+		}
+		return s.write(prefix+gcsRootTokenObject, token)
+	})
+}
+
+// LoadRootToken - reads the root token of the current generation and decrypts it with KMS
+func (s *GCSKeyStore) LoadRootToken() (string, error) {
+	prefix, err := s.currentPrefix()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := s.read(prefix + gcsRootTokenObject)
+	if err == storage.ErrObjectNotExist {
+		return "", fmt.Errorf("gcs: %s does not exist", gcsRootTokenObject)
+	}
+	return token, err
+}
+
+// Exists - checks whether the first unseal or recovery key of the current generation has been written to the bucket
+func (s *GCSKeyStore) Exists() (bool, error) {
+	prefix, err := s.currentPrefix()
+	if err != nil {
+		return false, err
+	}
+
+	for _, format := range []string{gcsUnsealKeyObject, gcsRecoveryKeyObject} {
+		_, err := s.bucket.Object(prefix + fmt.Sprintf(format, 1)).Attrs(s.ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("gcs: could not check for keys: %s", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Delete - removes the root token, unseal, recovery and retired keys of the current generation and the pointer to it
+func (s *GCSKeyStore) Delete() error {
+	prefix, err := s.currentPrefix()
+	if err != nil {
+		return err
+	}
+
+	if err := s.deleteSet(prefix); err != nil {
+		return err
+	}
+
+	if err := s.deleteObject(gcsCurrentObject); err != nil {
+		return err
+	}
+
+	// Keys written before generations were introduced sit at the top of the bucket
+	return s.deleteSet("")
+}
+
+// replace - writes a complete set of objects under a new generation prefix with fill, points gcsCurrentObject at it,
+// then removes the previous generation, so readers see either the old or the new keys and never a mix
+func (s *GCSKeyStore) replace(fill func(prefix string) error) error {
+	previous, err := s.currentPrefix()
+	if err != nil {
+		return err
+	}
+
+	prefix := gcsGenerationPrefix()
+	if err := fill(prefix); err != nil {
+		if deleteErr := s.deleteSet(prefix); deleteErr != nil {
+			logger.Warnf("Could not delete the incomplete generation %s: %s", prefix, deleteErr)
+		}
+		return err
+	}
+
+	if err := s.writeObject(gcsCurrentObject, []byte(prefix)); err != nil {
+		return err
+	}
+
+	// The new keys are in use, so a failure here only leaves unused objects behind
+	if err := s.deleteSet(previous); err != nil {
+		logger.Warnf("Could not delete the previous generation %q: %s", previous, err)
+	}
+
+	return nil
+}
+
+// currentPrefix - returns the prefix of the generation gcsCurrentObject points at, or the top of the bucket for keys written before generations
+func (s *GCSKeyStore) currentPrefix() (string, error) {
+	data, err := s.readObject(gcsCurrentObject)
+	if err == storage.ErrObjectNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// deleteSet - removes the root token, unseal, recovery and retired keys named with prefix
+func (s *GCSKeyStore) deleteSet(prefix string) error {
+	if err := s.deleteObject(prefix + gcsRootTokenObject); err != nil {
+		return err
+	}
+
+	for _, format := range []string{gcsUnsealKeyObject, gcsRecoveryKeyObject, gcsRetiredKeyObject} {
+		if err := s.deleteFrom(prefix+format, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteObject - deletes the named object, ignoring it if it is missing
+func (s *GCSKeyStore) deleteObject(name string) error {
+	err := s.bucket.Object(name).Delete(s.ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("gcs: could not delete %s: %s", name, err)
+	}
+	return nil
+}
+
+// deleteFrom - deletes the numbered objects named by format, starting at first, until one is missing
+func (s *GCSKeyStore) deleteFrom(format string, first int) error {
+	for i := first; ; i++ {
+		name := fmt.Sprintf(format, i)
+		err := s.bucket.Object(name).Delete(s.ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gcs: could not delete %s: %s", name, err)
+		}
+	}
+}
+
+// readAll - reads and decrypts the numbered objects named by format until one is missing
+func (s *GCSKeyStore) readAll(format string) ([]string, error) {
+	var keys []string
+
+	for i := 1; ; i++ {
+		key, err := s.read(fmt.Sprintf(format, i))
+		if err == storage.ErrObjectNotExist {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+}
+
+// Rotate - copies the current generation under a prefix named after version, then replaces the keys with tokens
+func (s *GCSKeyStore) Rotate(tokens VaultToken, version string) error {
+	current, err := s.currentPrefix()
+	if err != nil {
+		return err
+	}
+
+	if err := s.copyObjects(current, gcsBackupPrefix(version)); err != nil {
+		return err
+	}
+
+	return s.Save(tokens)
+}
+
+// Restore - copies the objects backed up under version into a new generation, switches to it and deletes the backup
+func (s *GCSKeyStore) Restore(version string) error {
+	backup := gcsBackupPrefix(version)
+
+	_, err := s.bucket.Object(backup + fmt.Sprintf(gcsUnsealKeyObject, 1)).Attrs(s.ctx)
+	if err == storage.ErrObjectNotExist {
+		_, err = s.bucket.Object(backup + fmt.Sprintf(gcsRecoveryKeyObject, 1)).Attrs(s.ctx)
+	}
+	if err == storage.ErrObjectNotExist {
+		return fmt.Errorf("gcs: backup %s does not exist", version)
+	}
+	if err != nil {
+		return fmt.Errorf("gcs: could not check for backup %s: %s", version, err)
+	}
+
+	if err := s.replace(func(prefix string) error { return s.copyObjects(backup, prefix) }); err != nil {
+		return err
+	}
+
+	return s.DeleteBackup(version)
+}
+
+// DeleteBackup - removes the objects backed up under version
+func (s *GCSKeyStore) DeleteBackup(version string) error {
+	return s.deleteSet(gcsBackupPrefix(version))
+}
+
+// copyObjects - copies the encrypted root token and keys named with the from prefix to the same names with the to prefix, without decrypting them
+func (s *GCSKeyStore) copyObjects(from, to string) error {
+	data, err := s.readObject(from + gcsRootTokenObject)
+	if err == nil {
+		err = s.writeObject(to+gcsRootTokenObject, data)
+	}
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+
+	for _, format := range []string{gcsUnsealKeyObject, gcsRecoveryKeyObject, gcsRetiredKeyObject} {
+		for i := 1; ; i++ {
+			data, err := s.readObject(from + fmt.Sprintf(format, i))
+			if err == storage.ErrObjectNotExist {
+				if err := s.deleteFrom(to+format, i); err != nil {
+					return err
+				}
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := s.writeObject(to+fmt.Sprintf(format, i), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// write - encrypts plaintext with KMS and stores the ciphertext as the named object
+func (s *GCSKeyStore) write(name, plaintext string) error {
+	ciphertext, err := kmsEncrypt(s.ctx, s.kms, s.kmsKeyID, []byte(plaintext))
+	if err != nil {
+		return fmt.Errorf("kms: could not encrypt %s: %s", name, err)
+	}
+
+	return s.writeObject(name, ciphertext)
+}
+
+// writeObject - stores data as the named object
+func (s *GCSKeyStore) writeObject(name string, data []byte) error {
+	w := s.bucket.Object(name).NewWriter(s.ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("gcs: could not write %s: %s", name, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("gcs: could not write %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// read - reads the named object and decrypts it with KMS, returning storage.ErrObjectNotExist if it is missing
+func (s *GCSKeyStore) read(name string) (string, error) {
+	ciphertext, err := s.readObject(name)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := kmsDecrypt(s.ctx, s.kms, s.kmsKeyID, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("kms: could not decrypt %s: %s", name, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// readObject - reads the named object, returning storage.ErrObjectNotExist if it is missing
+func (s *GCSKeyStore) readObject(name string) ([]byte, error) {
+	r, err := s.bucket.Object(name).NewReader(s.ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not read %s: %s", name, err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not read %s: %s", name, err)
+	}
+
+	return data, nil
+}
+
+// gcsGenerationPrefix - returns a new prefix for a complete set of objects, unique to the nanosecond
+func gcsGenerationPrefix() string {
+	return "generation-" + time.Now().UTC().Format("20060102-150405.000000000") + "/"
+}
+
+// gcsBackupPrefix - returns the prefix of the objects backed up under version
+func gcsBackupPrefix(version string) string {
+	return "backup-" + version + "/"
+}
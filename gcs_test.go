@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGoogle serves the subset of the GCS and Cloud KMS APIs used by GCSKeyStore
+type fakeGoogle struct {
+	sync.Mutex
+	objects map[string][]byte
+
+	// failUploads refuses uploads of objects whose name contains it
+	failUploads string
+}
+
+func (f *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case strings.HasSuffix(path, ":encrypt"), strings.HasSuffix(path, ":decrypt"):
+		var req struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if strings.HasSuffix(path, ":encrypt") {
+			plaintext, _ := base64.StdEncoding.DecodeString(req.Plaintext)
+			ciphertext := base64.StdEncoding.EncodeToString(append([]byte("kms:"), plaintext...))
+			json.NewEncoder(w).Encode(map[string]string{"ciphertext": ciphertext})
+			return
+		}
+
+		ciphertext, _ := base64.StdEncoding.DecodeString(req.Ciphertext)
+		if !strings.HasPrefix(string(ciphertext), "kms:") {
+			http.Error(w, `{"error":{"code":400,"message":"bad ciphertext"}}`, 400)
+			return
+		}
+		plaintext := base64.StdEncoding.EncodeToString(ciphertext[len("kms:"):])
+		json.NewEncoder(w).Encode(map[string]string{"plaintext": plaintext})
+
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		var attrs struct {
+			Bucket string `json:"bucket"`
+			Name   string `json:"name"`
+		}
+		part, _ := mr.NextPart()
+		json.NewDecoder(part).Decode(&attrs)
+		part, _ = mr.NextPart()
+		data, _ := ioutil.ReadAll(part)
+
+		if f.failUploads != "" && strings.Contains(attrs.Name, f.failUploads) {
+			http.Error(w, `{"error":{"code":403,"message":"Forbidden"}}`, 403)
+			return
+		}
+
+		f.objects[attrs.Name] = data
+		json.NewEncoder(w).Encode(attrs)
+
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		name, _ := url.PathUnescape(path[strings.Index(path, "/o/")+len("/o/"):])
+		if _, ok := f.objects[name]; !ok {
+			http.Error(w, `{"error":{"code":404,"message":"Not Found"}}`, 404)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			delete(f.objects, name)
+			w.WriteHeader(204)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": name})
+
+	default:
+		// Media downloads are served from storage.googleapis.com/<bucket>/<object>
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		data, ok := f.objects[parts[1]]
+		if !ok {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+// redirectTransport sends every request to the fake server regardless of the Google host requested
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func newTestGCSKeyStore(t *testing.T) (*GCSKeyStore, *fakeGoogle, *httptest.Server) {
+	fake := &fakeGoogle{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+
+	target, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	store, err := newGCSKeyStore(context.Background(), client, "vault-storage", "projects/p/locations/global/keyRings/r/cryptoKeys/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, fake, server
+}
+
+func TestGCSKeyStore(t *testing.T) {
+	store, fake, server := newTestGCSKeyStore(t)
+	defer server.Close()
+
+	exists, err := store.Exists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected no keys in an empty bucket")
+	}
+
+	tokens := VaultToken{
+		RootToken: "s.root",
+		Tokens:    []string{"key-a", "key-b", "key-c"},
+	}
+	if err := store.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pointer to the generation, the root token and three keys
+	if len(fake.objects) != 5 {
+		t.Fatalf("expected 5 objects, got %d", len(fake.objects))
+	}
+	prefix := string(fake.objects[gcsCurrentObject])
+	if string(fake.objects[prefix+"unseal-key-2.enc"]) != "kms:key-b" {
+		t.Fatalf("expected key to be stored encrypted under %q, got %v", prefix, fake.objects)
+	}
+
+	exists, err = store.Exists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("expected keys to exist after save")
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != tokens.RootToken || strings.Join(loaded.Tokens, ",") != strings.Join(tokens.Tokens, ",") {
+		t.Fatalf("loaded %+v, expected %+v", loaded, tokens)
+	}
+
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("expected all objects to be deleted, %d remain", len(fake.objects))
+	}
+}
+
+func TestGCSKeyStoreWithoutRootToken(t *testing.T) {
+	store, fake, server := newTestGCSKeyStore(t)
+	defer server.Close()
+
+	if err := store.Save(VaultToken{Tokens: []string{"key-a", "key-b"}}); err != nil {
+		t.Fatal(err)
+	}
+	prefix := string(fake.objects[gcsCurrentObject])
+	if _, ok := fake.objects[prefix+gcsRootTokenObject]; ok {
+		t.Fatal("expected no root token object to be written for an empty root token")
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "" || len(loaded.Tokens) != 2 {
+		t.Fatalf("expected the keys without a root token, got %+v", loaded)
+	}
+
+	if err := store.SaveRootToken("s.root"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "s.root" || strings.Join(loaded.Tokens, ",") != "key-a,key-b" {
+		t.Fatalf("expected the new root token alongside the keys, got %+v", loaded)
+	}
+}
+
+func TestGCSKeyStoreInterruptedSave(t *testing.T) {
+	store, fake, server := newTestGCSKeyStore(t)
+	defer server.Close()
+
+	if err := store.Save(VaultToken{RootToken: "s.old", Tokens: []string{"old-a", "old-b", "old-c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.failUploads = "unseal-key-2"
+	if err := store.Save(VaultToken{RootToken: "s.new", Tokens: []string{"new-a", "new-b", "new-c"}}); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	fake.failUploads = ""
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "s.old" || strings.Join(loaded.Tokens, ",") != "old-a,old-b,old-c" {
+		t.Fatalf("expected the old keys to stay whole, got %+v", loaded)
+	}
+	if len(fake.objects) != 5 {
+		t.Fatalf("expected the incomplete generation to be removed, got %d objects", len(fake.objects))
+	}
+}
+
+func TestGCSKeyStoreFlatLayout(t *testing.T) {
+	store, fake, server := newTestGCSKeyStore(t)
+	defer server.Close()
+
+	// Buckets written before generations hold the objects at the top level
+	fake.objects["unseal-key-1.enc"] = []byte("kms:key-a")
+	fake.objects["unseal-key-2.enc"] = []byte("kms:key-b")
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "" || strings.Join(loaded.Tokens, ",") != "key-a,key-b" {
+		t.Fatalf("expected the top level keys, got %+v", loaded)
+	}
+
+	if err := store.Save(VaultToken{Tokens: []string{"key-c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["unseal-key-1.enc"]; ok {
+		t.Fatal("expected the top level keys to be removed once replaced")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// GenerateRoot - creates a new root token with the stored unseal keys, or the recovery keys of an auto-unseal vault, using the one-time password flow
+func (v *VaultClient) GenerateRoot(store KeyStore) (string, error) {
+	status, err := v.SealStatus()
+	if err != nil {
+		return "", err
+	}
+	if status.Sealed {
+		return "", errors.New("generate-root: vault must be unsealed")
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		return "", fmt.Errorf("generate-root: could not load keys: %s", err)
+	}
+
+	keys := tokens.Tokens
+	if status.AutoUnseal() {
+		keys = tokens.RecoveryKeys
+	}
+
+	// An attempt left over from a crashed run used a one-time password that is now lost
+	current := GenerateRootResponse{}
+	if err := v.request("GET", "/v1/sys/generate-root/attempt", nil, &current); err != nil {
+		return "", err
+	}
+	if current.Started {
+		logger.Infof("Cancelling the generate-root attempt left by an earlier run")
+		if err := v.request("DELETE", "/v1/sys/generate-root/attempt", nil, nil); err != nil {
+			return "", err
+		}
+	}
+
+	// A vault reporting no otp_length expects a base64 encoded 16 byte one-time password to XOR the root token with,
+	// one reporting it expects a base62 one-time password of that length, which vault 1.10 and later generate themselves if none is sent
+	request := GenerateRootRequest{}
+	var legacyOTP []byte
+	if current.OTPLength == 0 {
+		legacyOTP = make([]byte, 16)
+		if _, err := rand.Read(legacyOTP); err != nil {
+			return "", err
+		}
+		request.OTP = base64.StdEncoding.EncodeToString(legacyOTP)
+	} else if request.OTP, err = randomBase62(current.OTPLength); err != nil {
+		return "", err
+	}
+
+	attempt := GenerateRootResponse{}
+	if err := v.request("PUT", "/v1/sys/generate-root/attempt", request, &attempt); err != nil {
+		return "", fmt.Errorf("generate-root: could not start: %s", err)
+	}
+
+	logger.Infof("Generating a root token, %d of the %d stored keys are required", attempt.Required, len(keys))
+
+	otp := request.OTP
+	if attempt.OTP != "" {
+		otp = attempt.OTP
+	}
+
+	result := GenerateRootResponse{}
+	if err := v.submitShares("/v1/sys/generate-root/update", attempt.Nonce, keys, &result); err != nil {
+		if cancelErr := v.request("DELETE", "/v1/sys/generate-root/attempt", nil, nil); cancelErr != nil {
+			logger.Warnf("Could not cancel the generate-root attempt: %s", cancelErr)
+		}
+		return "", fmt.Errorf("generate-root: %s", err)
+	}
+
+	encoded := result.EncodedToken
+	if encoded == "" {
+		encoded = result.EncodedRootToken
+	}
+
+	if legacyOTP != nil {
+		return decodeLegacyRootToken(encoded, legacyOTP)
+	}
+	return decodeRootToken(encoded, otp)
+}
+
+// randomBase62 - generates a random string of n letters and digits, the form of one-time password vault 1.0 and later expect
+func randomBase62(n int) (string, error) {
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	otp := make([]byte, 0, n)
+	b := make([]byte, 1)
+	for len(otp) < n {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		// Bytes past the last whole multiple of 62 would favour the first letters
+		if int(b[0]) >= 256/len(alphabet)*len(alphabet) {
+			continue
+		}
+		otp = append(otp, alphabet[int(b[0])%len(alphabet)])
+	}
+
+	return string(otp), nil
+}
+
+// RevokeSelf - revokes the token the client authenticates with
+func (v *VaultClient) RevokeSelf() error {
+	return v.request("POST", "/v1/auth/token/revoke-self", nil, nil)
+}
+
+// expiringRootToken - creates an orphan root token expiring after ttl, then revokes token which never expires
+func (v *VaultClient) expiringRootToken(token, ttl string) (string, error) {
+	client := &VaultClient{Addr: v.Addr, Token: token}
+
+	created := AuthResponse{}
+	request := TokenCreateRequest{
+		Policies:    []string{"root"},
+		TTL:         ttl,
+		DisplayName: "vault-init-generate-root",
+	}
+	if err := client.request("POST", "/v1/auth/token/create-orphan", request, &created); err != nil {
+		return "", fmt.Errorf("generate-root: could not create a root token with a TTL: %s", err)
+	}
+
+	if err := client.RevokeSelf(); err != nil {
+		logger.Warnf("Could not revoke the generated root token, which does not expire: %s", err)
+	}
+
+	registerSecrets(created.Auth.ClientToken)
+	return created.Auth.ClientToken, nil
+}
+
+// decodeRootToken - XORs the encoded token with the one-time password generated by vault
+func decodeRootToken(encoded, otp string) (string, error) {
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", fmt.Errorf("generate-root: could not decode token: %s", err)
+	}
+	if len(b) != len(otp) {
+		return "", fmt.Errorf("generate-root: encoded token is %d bytes but the one-time password is %d", len(b), len(otp))
+	}
+
+	for i := range b {
+		b[i] ^= otp[i]
+	}
+
+	return string(b), nil
+}
+
+// decodeLegacyRootToken - XORs the encoded token with a 16 byte one-time password, giving the UUID root token of vault before 1.10
+func decodeLegacyRootToken(encoded string, otp []byte) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("generate-root: could not decode token: %s", err)
+	}
+	if len(b) != len(otp) {
+		return "", fmt.Errorf("generate-root: encoded token is %d bytes but the one-time password is %d", len(b), len(otp))
+	}
+
+	for i := range b {
+		b[i] ^= otp[i]
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// generateRoot - generates a root token, exchanges it for one expiring after GENERATE_ROOT_TTL if set, then stores or prints it as GENERATE_ROOT_STORAGE says
+func generateRoot(vault *VaultClient, store KeyStore) error {
+	ttl := os.Getenv("GENERATE_ROOT_TTL")
+	if ttl != "" {
+		if _, err := time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("GENERATE_ROOT_TTL is invalid: %s", err)
+		}
+	}
+
+	// Check where the token goes before generating it, so a misconfiguration does not leave a root token nobody holds
+	var rootStore RootTokenStore
+	var operatorKey *rsa.PublicKey
+	var err error
+
+	switch os.Getenv("GENERATE_ROOT_STORAGE") {
+	case "", "store":
+		rootStore, err = rootTokenStore(store)
+		if err != nil {
+			return err
+		}
+	case "print":
+		path := os.Getenv("ROOT_TOKEN_PUBLIC_KEY_FILE")
+		if path == "" {
+			return errors.New("ROOT_TOKEN_PUBLIC_KEY_FILE must be set when GENERATE_ROOT_STORAGE is print")
+		}
+		operatorKey, err = LoadOperatorPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("ROOT_TOKEN_PUBLIC_KEY_FILE is invalid: %s", err)
+		}
+	default:
+		return errors.New("GENERATE_ROOT_STORAGE must be store or print")
+	}
+
+	token, err := vault.GenerateRoot(store)
+	registerSecrets(token)
+	if err != nil {
+		return err
+	}
+
+	if ttl != "" {
+		token, err = vault.expiringRootToken(token, ttl)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Root token expires in %s", ttl)
+	}
+
+	if operatorKey != nil {
+		encrypted, err := EncryptForOperator(operatorKey, token)
+		if err != nil {
+			return fmt.Errorf("could not encrypt root token: %s", err)
+		}
+
+		logger.With(Fields{"encrypted_root_token": encrypted}).Infof("Root token, encrypted to ROOT_TOKEN_PUBLIC_KEY_FILE and not stored")
+		return nil
+	}
+
+	if err := rootStore.SaveRootToken(token); err != nil {
+		if revokeErr := (&VaultClient{Addr: vault.Addr, Token: token}).RevokeSelf(); revokeErr != nil {
+			return fmt.Errorf("could not store the root token: %s, and could not revoke it: %s", err, revokeErr)
+		}
+		return fmt.Errorf("could not store the root token, it was revoked: %s", err)
+	}
+
+	logger.Infof("Root token stored")
+	return nil
+}
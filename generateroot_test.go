@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGenerateRoot(t *testing.T) {
+	_, server := newFakeKubernetes()
+	defer server.Close()
+
+	const otp = "0123456789abcdefghijklmnopqrstuv"
+	const rootToken = "hvs.generatedgeneratedgeneratedg"
+
+	progress := 0
+	var created TokenCreateRequest
+	var revoked string
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/seal-status":
+			json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Initialized: true, T: 2, N: 3})
+		case "/v1/sys/generate-root/attempt":
+			json.NewEncoder(w).Encode(GenerateRootResponse{ShareProgress: ShareProgress{Nonce: "nonce", Required: 2}, OTP: otp, OTPLength: len(otp)})
+		case "/v1/sys/generate-root/update":
+			var share ShareRequest
+			json.NewDecoder(r.Body).Decode(&share)
+			if share.Nonce != "nonce" {
+				w.WriteHeader(400)
+				return
+			}
+
+			progress++
+			if progress < 2 {
+				json.NewEncoder(w).Encode(GenerateRootResponse{ShareProgress: ShareProgress{Progress: progress, Required: 2}})
+				return
+			}
+
+			encoded := []byte(rootToken)
+			for i := range encoded {
+				encoded[i] ^= otp[i]
+			}
+			json.NewEncoder(w).Encode(GenerateRootResponse{
+				ShareProgress: ShareProgress{Complete: true},
+				EncodedToken:  base64.RawStdEncoding.EncodeToString(encoded),
+			})
+		case "/v1/auth/token/create-orphan":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.Write([]byte(`{"auth":{"client_token":"hvs.expiring","lease_duration":3600}}`))
+		case "/v1/auth/token/revoke-self":
+			revoked = r.Header.Get("X-Vault-Token")
+			w.WriteHeader(204)
+		}
+	}))
+	defer vault.Close()
+
+	os.Setenv("GENERATE_ROOT_TTL", "1h")
+	defer os.Unsetenv("GENERATE_ROOT_TTL")
+
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+	if err := store.Save(VaultToken{Tokens: []string{"k1", "k2", "k3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generateRoot(&VaultClient{Addr: vault.URL}, store); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked != rootToken {
+		t.Fatalf("expected the decoded root token to be revoked after creating an expiring one, got %q", revoked)
+	}
+	if created.TTL != "1h" || len(created.Policies) != 1 || created.Policies[0] != "root" {
+		t.Fatalf("expected a root token with a 1h TTL, got %+v", created)
+	}
+
+	stored, err := store.LoadRootToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != "hvs.expiring" {
+		t.Fatalf("expected the expiring root token to be stored, got %q", stored)
+	}
+}
+
+func TestDecodeLegacyRootToken(t *testing.T) {
+	otp := []byte("0123456789abcdef")
+	token := []byte{0x5b, 0x2c, 0x4e, 0x11, 0x0a, 0x3f, 0x4c, 0x7d, 0x9e, 0x01, 0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}
+
+	encoded := make([]byte, len(token))
+	for i := range token {
+		encoded[i] = token[i] ^ otp[i]
+	}
+
+	decoded, err := decodeLegacyRootToken(base64.StdEncoding.EncodeToString(encoded), otp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "5b2c4e11-0a3f-4c7d-9e01-abcdef123456" {
+		t.Fatalf("unexpected token %q", decoded)
+	}
+}
+
+func TestGenerateRootOTP(t *testing.T) {
+	legacyToken := []byte{0x5b, 0x2c, 0x4e, 0x11, 0x0a, 0x3f, 0x4c, 0x7d, 0x9e, 0x01, 0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}
+	const rootToken = "hvs.generatedgeneratedgenera"
+	const serverOTP = "abcdefghijklmnopqrstuvwxyz01"
+
+	tests := []struct {
+		name      string
+		otpLength int
+		serverOTP string
+		expected  string
+	}{
+		{"legacy 16 byte one-time password", 0, "", "5b2c4e11-0a3f-4c7d-9e01-abcdef123456"},
+		{"client generated one-time password", len(rootToken), "", rootToken},
+		{"server generated one-time password", len(rootToken), serverOTP, rootToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sent string
+
+			vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/sys/seal-status":
+					json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Initialized: true, T: 1, N: 1})
+				case "/v1/sys/generate-root/attempt":
+					if r.Method == "GET" {
+						json.NewEncoder(w).Encode(GenerateRootResponse{OTPLength: test.otpLength})
+						return
+					}
+					var request GenerateRootRequest
+					json.NewDecoder(r.Body).Decode(&request)
+					sent = request.OTP
+					json.NewEncoder(w).Encode(GenerateRootResponse{ShareProgress: ShareProgress{Nonce: "nonce", Started: true, Required: 1}, OTP: test.serverOTP})
+				case "/v1/sys/generate-root/update":
+					response := GenerateRootResponse{ShareProgress: ShareProgress{Complete: true}}
+
+					if test.otpLength == 0 {
+						otp, _ := base64.StdEncoding.DecodeString(sent)
+						encoded := make([]byte, len(legacyToken))
+						for i := range encoded {
+							encoded[i] = legacyToken[i] ^ otp[i]
+						}
+						response.EncodedRootToken = base64.StdEncoding.EncodeToString(encoded)
+					} else {
+						otp := sent
+						if test.serverOTP != "" {
+							otp = test.serverOTP
+						}
+						encoded := []byte(rootToken)
+						for i := range encoded {
+							encoded[i] ^= otp[i]
+						}
+						response.EncodedToken = base64.RawStdEncoding.EncodeToString(encoded)
+					}
+
+					json.NewEncoder(w).Encode(response)
+				}
+			}))
+			defer vault.Close()
+
+			store := &memoryKeyStore{}
+			store.Save(VaultToken{Tokens: []string{"k1"}})
+
+			token, err := (&VaultClient{Addr: vault.URL}).GenerateRoot(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, token)
+			}
+
+			if test.otpLength == 0 {
+				if otp, err := base64.StdEncoding.DecodeString(sent); err != nil || len(otp) != 16 {
+					t.Fatalf("expected a base64 encoded 16 byte one-time password, got %q", sent)
+				}
+			} else if len(sent) != test.otpLength || strings.Trim(sent, "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz") != "" {
+				t.Fatalf("expected a base62 one-time password of %d characters, got %q", test.otpLength, sent)
+			}
+		})
+	}
+}
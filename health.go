@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// VaultState is the state of a vault server that decides what vault-init does with it
+type VaultState string
+
+const (
+	// StateUninitialized servers are initialized, or joined to their raft cluster
+	StateUninitialized VaultState = "uninitialized"
+
+	// StateSealed servers are unsealed with the stored keys
+	StateSealed VaultState = "sealed"
+
+	// StateActive servers are bootstrapped
+	StateActive VaultState = "active"
+
+	// StateStandby, StatePerfStandby and StateDRSecondary servers need nothing
+	StateStandby     VaultState = "standby"
+	StatePerfStandby VaultState = "performance standby"
+	StateDRSecondary VaultState = "DR secondary"
+)
+
+// VaultStates lists every state, in the order they are reported
+var VaultStates = []VaultState{StateUninitialized, StateSealed, StateActive, StateStandby, StatePerfStandby, StateDRSecondary}
+
+// VaultStatus is what sys/health and sys/seal-status report about a vault server
+type VaultStatus struct {
+	Initialized        bool
+	Sealed             bool
+	Standby            bool
+	PerformanceStandby bool
+	DRSecondary        bool
+	Version            string
+	ClusterName        string
+	ClusterID          string
+
+	// Seal is the seal-status response, with the seal type and unseal progress
+	Seal SealStatusResponse
+}
+
+// healthStatusCodes are the status codes sys/health answers with, each with the health JSON
+var healthStatusCodes = map[int]bool{200: true, 429: true, 472: true, 473: true, 501: true, 503: true}
+
+// Status - reads sys/health and sys/seal-status
+func (v *VaultClient) Status() (VaultStatus, error) {
+	res, err := httpClient.Get(v.URL("/v1/sys/health"))
+	if err != nil {
+		return VaultStatus{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return VaultStatus{}, err
+	}
+
+	if !healthStatusCodes[res.StatusCode] {
+		return VaultStatus{}, fmt.Errorf("health: unexpected status code: %d", res.StatusCode)
+	}
+
+	health := HealthResponse{}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return VaultStatus{}, fmt.Errorf("health: %s", err)
+	}
+
+	seal, err := v.SealStatus()
+	if err != nil {
+		return VaultStatus{}, err
+	}
+
+	status := VaultStatus{
+		Initialized:        health.Initialized,
+		Sealed:             health.Sealed,
+		Standby:            health.Standby,
+		PerformanceStandby: health.PerformanceStandby,
+		DRSecondary:        health.ReplicationDRMode == "secondary",
+		Version:            health.Version,
+		ClusterName:        health.ClusterName,
+		ClusterID:          health.ClusterID,
+		Seal:               seal,
+	}
+
+	// Sealed servers only report their cluster through seal-status, once they joined one
+	if status.ClusterID == "" {
+		status.ClusterName, status.ClusterID = seal.ClusterName, seal.ClusterID
+	}
+	if status.Version == "" {
+		status.Version = seal.Version
+	}
+
+	return status, nil
+}
+
+// State - returns the state vault-init acts on, in the order sys/health picks its status code
+func (s VaultStatus) State() VaultState {
+	switch {
+	case !s.Initialized:
+		return StateUninitialized
+	case s.Sealed:
+		return StateSealed
+	case s.DRSecondary:
+		return StateDRSecondary
+	case s.PerformanceStandby:
+		return StatePerfStandby
+	case s.Standby:
+		return StateStandby
+	default:
+		return StateActive
+	}
+}
+
+// String - describes the state, version and cluster for logs
+func (s VaultStatus) String() string {
+	description := string(s.State())
+	if s.Version != "" {
+		description += ", version " + s.Version
+	}
+	if s.ClusterID != "" {
+		description += ", cluster " + s.ClusterName + " (" + s.ClusterID + ")"
+	}
+	return description
+}
+
+// StateMachine remembers the last state of each vault server, so changes are noticed once
+type StateMachine struct {
+	mu     sync.Mutex
+	states map[string]VaultState
+}
+
+// Transition - records the state of the named server, returning its previous state and whether it changed
+func (m *StateMachine) Transition(name string, state VaultState) (VaultState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.states == nil {
+		m.states = map[string]VaultState{}
+	}
+
+	previous, seen := m.states[name]
+	m.states[name] = state
+
+	return previous, !seen || previous != state
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaultStatus(t *testing.T) {
+	for _, test := range []struct {
+		code     int
+		health   string
+		expected VaultState
+	}{
+		{501, `{"initialized":false,"sealed":true}`, StateUninitialized},
+		{503, `{"initialized":true,"sealed":true}`, StateSealed},
+		{200, `{"initialized":true,"sealed":false,"standby":false}`, StateActive},
+		{429, `{"initialized":true,"sealed":false,"standby":true}`, StateStandby},
+		{473, `{"initialized":true,"sealed":false,"standby":true,"performance_standby":true}`, StatePerfStandby},
+		{472, `{"initialized":true,"sealed":false,"standby":false,"replication_dr_mode":"secondary"}`, StateDRSecondary},
+	} {
+		vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/sys/seal-status" {
+				w.Write([]byte(`{"type":"shamir","version":"1.15.2","cluster_name":"vault-cluster","cluster_id":"abc"}`))
+				return
+			}
+			w.WriteHeader(test.code)
+			w.Write([]byte(test.health))
+		}))
+
+		status, err := (&VaultClient{Addr: vault.URL}).Status()
+		vault.Close()
+		if err != nil {
+			t.Fatalf("%d: %s", test.code, err)
+		}
+
+		if state := status.State(); state != test.expected {
+			t.Errorf("%d: expected %s, got %s", test.code, test.expected, state)
+		}
+		if status.Version != "1.15.2" || status.ClusterID != "abc" {
+			t.Errorf("%d: expected the version and cluster from seal-status, got %+v", test.code, status)
+		}
+	}
+}
+
+func TestStateMachine(t *testing.T) {
+	states := &StateMachine{}
+
+	if previous, changed := states.Transition("vault-0", StateSealed); !changed || previous != "" {
+		t.Fatalf("expected the first state to be a change, got %q, %v", previous, changed)
+	}
+	if _, changed := states.Transition("vault-0", StateSealed); changed {
+		t.Fatal("expected the same state not to be a change")
+	}
+	if previous, changed := states.Transition("vault-0", StateActive); !changed || previous != StateSealed {
+		t.Fatalf("expected a change from sealed, got %q, %v", previous, changed)
+	}
+	if _, changed := states.Transition("vault-1", StateActive); !changed {
+		t.Fatal("expected servers to be tracked separately")
+	}
+}
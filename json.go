@@ -15,15 +15,3 @@ func toJSON(v interface{}) bytes.Buffer {
 
 	return b
 }
-
-func fromJSON(b []byte, v interface{}) interface{} {
-
-	r := bytes.NewReader(b)
-
-	err := json.NewDecoder(r).Decode(v)
-	if err != nil {
-		panic(err)
-	}
-
-	return v
-}
@@ -1,183 +1,619 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// GetSecret - retrieves secret from Kubernetes
-func GetSecret() Secret {
-	req, err := http.NewRequest("GET", GetSecretURL()+"/"+vaultSecretName, nil)
+// KubernetesKeyStore stores the unseal keys and the root token in separate Kubernetes secrets
+type KubernetesKeyStore struct {
+	// force allows a secret holding different keys to be overwritten
+	force bool
+
+	// rootTokenSecret and rootTokenNamespace locate the secret holding the root token
+	rootTokenSecret    string
+	rootTokenNamespace string
+
+	// rootTokenPublicKey, when set, is used to print the root token encrypted instead of storing it
+	rootTokenPublicKey *rsa.PublicKey
+
+	// labels, annotations and owner are added to the secrets, from SECRET_LABELS, SECRET_ANNOTATIONS and SECRET_OWNER_STATEFULSET
+	labels      map[string]string
+	annotations map[string]string
+	owner       []OwnerReference
+}
+
+// NewKubernetesKeyStore - creates a key store backed by the vault-tokens secret, configured by FORCE_OVERWRITE, the ROOT_TOKEN_* and the SECRET_* variables,
+// resolving them all up front so a bad value fails at startup rather than after vault is initialized
+func NewKubernetesKeyStore() (KeyStore, error) {
+	s := &KubernetesKeyStore{
+		rootTokenSecret:    os.Getenv("ROOT_TOKEN_SECRET_NAME"),
+		rootTokenNamespace: os.Getenv("ROOT_TOKEN_SECRET_NAMESPACE"),
+	}
+
+	if s.rootTokenSecret == "" {
+		s.rootTokenSecret = rootTokenSecretName
+	}
+
+	if v := os.Getenv("FORCE_OVERWRITE"); v != "" {
+		var err error
+		s.force, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("FORCE_OVERWRITE is invalid: %s", err)
+		}
+	}
+
+	switch os.Getenv("ROOT_TOKEN_STORAGE") {
+	case "", "secret":
+	case "print":
+		path := os.Getenv("ROOT_TOKEN_PUBLIC_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("ROOT_TOKEN_PUBLIC_KEY_FILE must be set when ROOT_TOKEN_STORAGE is print")
+		}
+
+		var err error
+		s.rootTokenPublicKey, err = LoadOperatorPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("ROOT_TOKEN_PUBLIC_KEY_FILE is invalid: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("ROOT_TOKEN_STORAGE must be secret or print")
+	}
+
+	var err error
+	s.labels, err = parseKeyValues(os.Getenv("SECRET_LABELS"))
 	if err != nil {
-		log.Print(err)
+		return nil, fmt.Errorf("SECRET_LABELS is invalid: %s", err)
 	}
 
-	req.Header.Add("Content-Type", "application/json")
+	s.annotations, err = parseKeyValues(os.Getenv("SECRET_ANNOTATIONS"))
+	if err != nil {
+		return nil, fmt.Errorf("SECRET_ANNOTATIONS is invalid: %s", err)
+	}
+
+	if statefulSet := os.Getenv("SECRET_OWNER_STATEFULSET"); statefulSet != "" {
+		owner, err := getStatefulSet(statefulSet)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_OWNER_STATEFULSET is invalid: %s", err)
+		}
 
-	token := GetBearerToken()
-	if token != "" {
-		req.Header.Add("Authorization", "Bearer "+string(token))
+		s.owner = []OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "StatefulSet",
+			Name:       owner.Metadata.Name,
+			UID:        owner.Metadata.UID,
+		}}
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+	return s, nil
+}
+
+// Save - stores the unseal keys in the vault-tokens secret and the root token in its own secret, or prints it encrypted
+func (s *KubernetesKeyStore) Save(tokens VaultToken) error {
+	existing, err := GetSecret()
 	if err != nil {
-		panic(err) // Can't find cert file
+		return err
 	}
-	caCertPool.AppendCertsFromPEM(caCert)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
-		},
+	// A seal migration rearranges the keys of the same initialization, any other keys saved here come from a new one
+	previous := MetaData{}
+	if len(tokens.RetiredKeys) > 0 {
+		previous = existing.Metadata
+	}
+
+	secret := s.keySecret(tokens, previous)
+	metadata := secret.Metadata
+
+	// Without stored keys a root token secret can only be left from an earlier initialization, and refusing to replace it would lose the new root token
+	hadKeys := existing.Data["key1"] != "" || existing.Data["recovery-key1"] != ""
+
+	// A seal migration rewrites the keys but keeps the old ones as retired keys, so nothing is lost by replacing the secret
+	if err := saveSecret(secret, s.force || len(tokens.RetiredKeys) > 0); err != nil {
+		return err
+	}
+
+	if tokens.RootToken == "" {
+		return nil
+	}
+
+	return s.saveRootToken(tokens.RootToken, metadata, s.force || !hadKeys)
+}
+
+// SaveRootToken - replaces the root token in its secret, or prints it encrypted, leaving the unseal keys untouched
+func (s *KubernetesKeyStore) SaveRootToken(token string) error {
+	metadata := s.secretMetadata(s.rootTokenSecret, VaultToken{}, MetaData{})
+
+	// The root token was not created along with the keys these describe
+	delete(metadata.Annotations, "vault-init/secret-shares")
+	delete(metadata.Annotations, "vault-init/secret-threshold")
+
+	return s.saveRootToken(token, metadata, true)
+}
+
+// saveRootToken - stores token in the root token secret with metadata, or prints it encrypted when ROOT_TOKEN_STORAGE is print
+func (s *KubernetesKeyStore) saveRootToken(token string, metadata MetaData, force bool) error {
+	if s.rootTokenPublicKey != nil {
+		encrypted, err := EncryptForOperator(s.rootTokenPublicKey, token)
+		if err != nil {
+			return fmt.Errorf("could not encrypt root token: %s", err)
+		}
+
+		logger.With(Fields{"encrypted_root_token": encrypted}).Infof("Root token, encrypted to ROOT_TOKEN_PUBLIC_KEY_FILE and not stored")
+		return nil
+	}
+
+	rootSecret := newSecret(s.rootTokenSecret, K8sSecrets{
+		"root-token": base64.StdEncoding.EncodeToString([]byte(token)),
+	})
+	rootSecret.Metadata.Labels = metadata.Labels
+	rootSecret.Metadata.Annotations = metadata.Annotations
+	rootSecret.Metadata.OwnerReferences = metadata.OwnerReferences
+	rootSecret.Metadata.Name = s.rootTokenSecret
+	rootSecret.Metadata.Namespace = s.namespace()
+
+	if rootSecret.Metadata.Namespace != kubeClient.Namespace {
+		// Owner references can not cross namespaces
+		rootSecret.Metadata.OwnerReferences = nil
 	}
 
-	res, err := client.Do(req)
+	return saveSecret(rootSecret, force)
+}
+
+// Rotate - copies the vault-tokens secret to a backup named after version, then replaces its keys with tokens
+func (s *KubernetesKeyStore) Rotate(tokens VaultToken, version string) error {
+	existing, err := GetSecret()
 	if err != nil {
-		log.Print(err)
-		// panic(err)
+		return err
+	}
+	if existing.Metadata.ResourceVersion == "" {
+		return fmt.Errorf("secret %s does not exist", vaultSecretName)
 	}
-	defer res.Body.Close()
 
-	k8sResponse, err := ioutil.ReadAll(res.Body)
+	backup := newSecret(vaultSecretName+"-"+version, existing.Data)
+	backup.Metadata.Labels = existing.Metadata.Labels
+	backup.Metadata.Annotations = existing.Metadata.Annotations
+	if err := postSecret(backup); err != nil {
+		return err
+	}
+
+	// The new keys belong to the same initialization
+	secret := s.keySecret(tokens, existing.Metadata)
+
+	// Secrets written before the root token was split out keep it next to the new keys
+	if rootToken := existing.Data["root-token"]; rootToken != "" {
+		secret.Data["root-token"] = rootToken
+	}
+
+	secret.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	return putSecret(secret)
+}
+
+// Restore - puts the keys from the backup named after version back in the vault-tokens secret and deletes the backup
+func (s *KubernetesKeyStore) Restore(version string) error {
+	backupName := vaultSecretName + "-" + version
+
+	backup, err := getSecret(kubeClient.Namespace, backupName)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	if backup.Metadata.ResourceVersion == "" {
+		return fmt.Errorf("backup secret %s does not exist", backupName)
 	}
 
-	target := Secret{}
-	fromJSON(k8sResponse, &target)
-	return target
+	existing, err := GetSecret()
+	if err != nil {
+		return err
+	}
+
+	secret := newSecret(vaultSecretName, backup.Data)
+	secret.Metadata.Labels = backup.Metadata.Labels
+	secret.Metadata.Annotations = backup.Metadata.Annotations
+	secret.Metadata.OwnerReferences = existing.Metadata.OwnerReferences
+	secret.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+
+	if existing.Metadata.ResourceVersion == "" {
+		err = postSecret(secret)
+	} else {
+		err = putSecret(secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.DeleteBackup(version)
 }
 
-// IsSecretExists - checks if secret exists already in Kubernetes
-func IsSecretExists() (bool, string) {
-	log.Print("Checking for tokens")
-	token := GetSecret()
-	if token.Data.RootToken == "" {
-		return false, ""
+// DeleteBackup - deletes the backup of the vault-tokens secret named after version
+func (s *KubernetesKeyStore) DeleteBackup(version string) error {
+	return deleteSecret(kubeClient.Namespace, vaultSecretName+"-"+version)
+}
+
+// Load - reads the unseal, recovery and retired keys from the vault-tokens secret, only needing access to that secret
+func (s *KubernetesKeyStore) Load() (VaultToken, error) {
+	secret, err := GetSecret()
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	if secret.Data["key1"] == "" && secret.Data["recovery-key1"] == "" {
+		return VaultToken{}, fmt.Errorf("secret %s does not exist", vaultSecretName)
+	}
+
+	var tokens VaultToken
+
+	// Secrets written before the root token was split out still hold it next to the keys
+	if secret.Data["root-token"] != "" {
+		rootToken, err := base64.StdEncoding.DecodeString(secret.Data["root-token"])
+		if err != nil {
+			return VaultToken{}, fmt.Errorf("could not decode root-token: %s", err)
+		}
+		tokens.RootToken = string(rootToken)
+	}
+
+	if tokens.Tokens, err = getKeys(secret.Data, "key"); err != nil {
+		return VaultToken{}, err
+	}
+
+	if tokens.RecoveryKeys, err = getKeys(secret.Data, "recovery-key"); err != nil {
+		return VaultToken{}, err
+	}
+
+	if tokens.RetiredKeys, err = getKeys(secret.Data, "retired-key"); err != nil {
+		return VaultToken{}, err
+	}
+
+	return tokens, nil
+}
+
+// keySecret - builds the vault-tokens secret holding the unseal, recovery and retired keys of tokens, keeping what previous recorded about their initialization
+func (s *KubernetesKeyStore) keySecret(tokens VaultToken, previous MetaData) Secret {
+	metadata := s.secretMetadata(vaultSecretName, tokens, previous)
+
+	data := K8sSecrets{}
+	putKeys(data, "key", tokens.Tokens)
+	putKeys(data, "recovery-key", tokens.RecoveryKeys)
+	putKeys(data, "retired-key", tokens.RetiredKeys)
+
+	secret := newSecret(vaultSecretName, data)
+	secret.Metadata = metadata
+	secret.Metadata.Namespace = kubeClient.Namespace
+
+	return secret
+}
+
+// putKeys - adds keys to data as prefix1..prefixN
+func putKeys(data K8sSecrets, prefix string, keys []string) {
+	for i, key := range keys {
+		data[prefix+strconv.Itoa(i+1)] = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+}
+
+// getKeys - reads the keys stored in data as prefix1..prefixN
+func getKeys(data K8sSecrets, prefix string) ([]string, error) {
+	var keys []string
+
+	for i := 1; ; i++ {
+		k, ok := data[prefix+strconv.Itoa(i)]
+		if !ok {
+			return keys, nil
+		}
+
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode %s%d: %s", prefix, i, err)
+		}
+		keys = append(keys, string(key))
 	}
-	return true, "Secret Exists!"
 }
 
-// SaveTokens - checks for tokens then formats to be saved
-func SaveTokens(tokens VaultToken) {
-	exists, err := IsSecretExists()
+// LoadRootToken - reads the root token from its secret, falling back to a legacy root-token in the vault-tokens secret
+func (s *KubernetesKeyStore) LoadRootToken() (string, error) {
+	secret, err := getSecret(s.namespace(), s.rootTokenSecret)
+	if err != nil {
+		return "", err
+	}
 
-	if exists == true {
-		log.Print(err)
+	if secret.Data["root-token"] == "" {
+		secret, err = GetSecret()
+		if err != nil {
+			return "", err
+		}
 	}
 
-	secret := K8sSecrets{
-		RootToken: base64.StdEncoding.EncodeToString([]byte(tokens.RootToken)),
-		Token1:    base64.StdEncoding.EncodeToString([]byte(tokens.Tokens[0])),
-		Token2:    base64.StdEncoding.EncodeToString([]byte(tokens.Tokens[1])),
-		Token3:    base64.StdEncoding.EncodeToString([]byte(tokens.Tokens[2])),
-		Token4:    base64.StdEncoding.EncodeToString([]byte(tokens.Tokens[3])),
-		Token5:    base64.StdEncoding.EncodeToString([]byte(tokens.Tokens[4])),
+	if secret.Data["root-token"] == "" {
+		return "", fmt.Errorf("no root token is stored")
+	}
+
+	rootToken, err := base64.StdEncoding.DecodeString(secret.Data["root-token"])
+	if err != nil {
+		return "", fmt.Errorf("could not decode root-token: %s", err)
 	}
 
-	CreateSecret(secret)
+	return string(rootToken), nil
 }
 
-// CreateSecret - creates the secret in Kubernetes
-func CreateSecret(vault K8sSecrets) {
-	secret := Secret{
-		Kind:       "Secret",
-		APIVersion: "v1",
-		Metadata: MetaData{
-			Name: vaultSecretName,
-		},
-		Data: vault,
+// Exists - checks whether the Kubernetes secret holds unseal or recovery keys
+func (s *KubernetesKeyStore) Exists() (bool, error) {
+	return IsSecretExists()
+}
+
+// Delete - removes the vault-tokens and root token secrets
+func (s *KubernetesKeyStore) Delete() error {
+	if err := deleteSecret(s.namespace(), s.rootTokenSecret); err != nil {
+		return err
 	}
+	return DeleteSecret()
+}
 
-	b := toJSON(secret)
+// namespace - returns the namespace of the root token secret
+func (s *KubernetesKeyStore) namespace() string {
+	if s.rootTokenNamespace != "" {
+		return s.rootTokenNamespace
+	}
+	return kubeClient.Namespace
+}
 
-	req, err := http.NewRequest("POST", GetSecretURL(), &b)
+// GetSecret - retrieves secret from Kubernetes, returning an empty secret if it does not exist
+func GetSecret() (Secret, error) {
+	return getSecret(kubeClient.Namespace, vaultSecretName)
+}
+
+// getSecret - retrieves the named secret from Kubernetes, returning an empty secret if it does not exist
+func getSecret(namespace, name string) (Secret, error) {
+	target := Secret{}
+
+	res, err := kubernetesRequest("GET", secretsURL(namespace)+"/"+name, nil)
+	if err != nil {
+		return target, err
+	}
+	defer res.Body.Close()
+
+	k8sResponse, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Print(err)
-		// panic(err)
+		return target, err
 	}
 
-	token := GetBearerToken()
-	if token == "" {
-		log.Printf("No kubernetes token exists!!!")
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return target, nil
+	default:
+		return target, fmt.Errorf("get secret %s: non 200 status code: %d", name, res.StatusCode)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", string(token)))
+	if err := json.Unmarshal(k8sResponse, &target); err != nil {
+		return target, fmt.Errorf("get secret %s: %s", name, err)
+	}
+	return target, nil
+}
 
-	caCertPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+// IsSecretExists - checks if secret exists already in Kubernetes
+func IsSecretExists() (bool, error) {
+	logger.Debugf("Checking for tokens")
+	secret, err := GetSecret()
 	if err != nil {
-		panic(err) // Can't find cert file
+		return false, err
+	}
+	return secret.Data["key1"] != "" || secret.Data["recovery-key1"] != "", nil
+}
+
+// saveSecret - creates the secret, or updates it when force is set and it already holds different data
+func saveSecret(secret Secret, force bool) error {
+	name := secret.Metadata.Name
+
+	existing, err := getSecret(secret.Metadata.Namespace, name)
+	if err != nil {
+		return err
+	}
+
+	if existing.Metadata.ResourceVersion == "" {
+		return postSecret(secret)
+	}
+
+	if reflect.DeepEqual(existing.Data, secret.Data) {
+		logger.Infof("Secret %s exists with the same keys", name)
+		return nil
+	}
+
+	if !force {
+		return fmt.Errorf("secret %s already holds different keys, set FORCE_OVERWRITE=true to replace it", name)
+	}
+
+	backupName := name + "-backup-" + time.Now().UTC().Format("20060102-150405")
+	logger.Infof("Secret %s holds different keys, backing it up to %s before overwriting", name, backupName)
+
+	backup := newSecret(backupName, existing.Data)
+	backup.Metadata.Namespace = secret.Metadata.Namespace
+	backup.Metadata.Labels = existing.Metadata.Labels
+	backup.Metadata.Annotations = existing.Metadata.Annotations
+	if err := postSecret(backup); err != nil {
+		return err
 	}
-	caCertPool.AppendCertsFromPEM(caCert)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
+	secret.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+
+	return putSecret(secret)
+}
+
+// secretMetadata - builds the labels, annotations and owner of the secret holding tokens, keeping the initialization time and
+// threshold recorded in previous unless tokens come with their own threshold
+func (s *KubernetesKeyStore) secretMetadata(name string, tokens VaultToken, previous MetaData) MetaData {
+	metadata := MetaData{
+		Name: name,
+		Labels: map[string]string{
+			"app.kubernetes.io/managed-by": "vault-init",
 		},
+		Annotations: map[string]string{
+			"vault-init/initialized-at": previous.Annotations["vault-init/initialized-at"],
+			"vault-init/secret-shares":  strconv.Itoa(len(tokens.Tokens) + len(tokens.RecoveryKeys)),
+		},
+		OwnerReferences: s.owner,
+	}
+
+	if metadata.Annotations["vault-init/initialized-at"] == "" {
+		metadata.Annotations["vault-init/initialized-at"] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if tokens.Threshold > 0 {
+		metadata.Annotations["vault-init/secret-threshold"] = strconv.Itoa(tokens.Threshold)
+	} else if threshold := previous.Annotations["vault-init/secret-threshold"]; threshold != "" {
+		metadata.Annotations["vault-init/secret-threshold"] = threshold
+	}
+
+	if tokens.VaultVersion != "" {
+		metadata.Annotations["vault-init/vault-version"] = tokens.VaultVersion
+	}
+
+	for k, v := range s.labels {
+		metadata.Labels[k] = v
 	}
 
-	res, err := client.Do(req)
+	for k, v := range s.annotations {
+		metadata.Annotations[k] = v
+	}
+
+	return metadata
+}
+
+// getStatefulSet - retrieves the named statefulset from the namespace vault-init runs in
+func getStatefulSet(name string) (KubernetesObject, error) {
+	target := KubernetesObject{}
+
+	res, err := kubernetesRequest("GET", "/apis/apps/v1/namespaces/"+kubeClient.Namespace+"/statefulsets/"+name, nil)
 	if err != nil {
-		log.Print(err)
-		// panic(err)
+		return target, err
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != 201 {
-		panic("init: non 201 status code: " + strconv.Itoa(res.StatusCode))
+	k8sResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return target, err
+	}
+
+	if res.StatusCode != 200 {
+		return target, fmt.Errorf("get statefulset %s: non 200 status code: %d", name, res.StatusCode)
+	}
+
+	if err := json.Unmarshal(k8sResponse, &target); err != nil {
+		return target, fmt.Errorf("get statefulset %s: %s", name, err)
 	}
+	return target, nil
 }
 
-// GetBearerToken - grabs the token from /var/run/secrets/kubernetes.io/serviceaccount/token - needs correct RBAC permissions
-func GetBearerToken() string {
+// parseKeyValues - parses comma separated key=value pairs such as "team=infra,tier=vault"
+func parseKeyValues(s string) (map[string]string, error) {
+	m := map[string]string{}
 
-	location := "/var/run/secrets/kubernetes.io/serviceaccount/token"
-	_, er := os.Stat(location)
-	if er == nil {
-		token, err := ioutil.ReadFile(location)
-		if err != nil {
-			panic(err)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
 		}
 
-		return string(token)
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
 	}
 
-	return ""
+	return m, nil
 }
 
-// GetSecretURL - formats the URL to access Kubernetes secrets
-func GetSecretURL() string {
+// newSecret - builds a secret holding data in the namespace vault-init runs in
+func newSecret(name string, data K8sSecrets) Secret {
+	return Secret{
+		Kind:       "Secret",
+		APIVersion: "v1",
+		Metadata: MetaData{
+			Name:      name,
+			Namespace: kubeClient.Namespace,
+		},
+		Data: data,
+	}
+}
+
+// postSecret - creates a new secret, failing if one with the same name exists
+func postSecret(secret Secret) error {
+	b := toJSON(secret)
 
-	var url string
+	res, err := kubernetesRequest("POST", secretsURL(secret.Metadata.Namespace), &b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
-	namespace := os.Getenv("KUBERNETES_NAMESPACE")
+	switch res.StatusCode {
+	case 201:
+		return nil
+	case 409:
+		return fmt.Errorf("create secret %s: secret already exists", secret.Metadata.Name)
+	default:
+		return fmt.Errorf("create secret %s: non 201 status code: %d", secret.Metadata.Name, res.StatusCode)
+	}
+}
+
+// putSecret - replaces an existing secret, failing if it changed since its resourceVersion was read
+func putSecret(secret Secret) error {
+	b := toJSON(secret)
 
-	if namespace == "" {
-		namespace = "default"
+	res, err := kubernetesRequest("PUT", secretsURL(secret.Metadata.Namespace)+"/"+secret.Metadata.Name, &b)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
 
-	host := os.Getenv("KUBERNETES_SERVICE_HOST")
-	port := os.Getenv("KUBERNETES_SERVICE_PORT")
-	if host != "" && port != "" {
-		url = "https://" + host + ":" + port
+	switch res.StatusCode {
+	case 200:
+		return nil
+	case 409:
+		return fmt.Errorf("update secret %s: secret was modified concurrently", secret.Metadata.Name)
+	default:
+		return fmt.Errorf("update secret %s: non 200 status code: %d", secret.Metadata.Name, res.StatusCode)
+	}
+}
 
-	} else {
-		url = "http://localhost:8001"
+// DeleteSecret - deletes the secret from Kubernetes
+func DeleteSecret() error {
+	return deleteSecret(kubeClient.Namespace, vaultSecretName)
+}
+
+// deleteSecret - deletes the named secret, succeeding if it does not exist
+func deleteSecret(namespace, name string) error {
+	res, err := kubernetesRequest("DELETE", secretsURL(namespace)+"/"+name, nil)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 404 {
+		return fmt.Errorf("delete secret %s: non 200 status code: %d", name, res.StatusCode)
+	}
+
+	return nil
+}
+
+// kubernetesRequest - sends an authenticated request to the Kubernetes API
+func kubernetesRequest(method, url string, body io.Reader) (*http.Response, error) {
+	return kubeClient.Do(method, url, body)
+}
+
+// GetSecretURL - formats the URL to access Kubernetes secrets
+func GetSecretURL() string {
+	return secretsURL(kubeClient.Namespace)
+}
 
-	return url + "/api/v1/namespaces/" + namespace + "/secrets"
+// secretsURL - formats the URL to access Kubernetes secrets in namespace
+func secretsURL(namespace string) string {
+	return kubeClient.Host + "/api/v1/namespaces/" + namespace + "/secrets"
 }
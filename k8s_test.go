@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubernetes is a minimal API server storing objects by their URL path
+type fakeKubernetes struct {
+	sync.Mutex
+	objects map[string]map[string]interface{}
+	version int
+}
+
+func newFakeKubernetes() (*fakeKubernetes, *httptest.Server) {
+	fake := &fakeKubernetes{objects: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(fake)
+
+	kubeClient = &KubernetesClient{
+		Host:      server.URL,
+		Namespace: "vault",
+		client:    server.Client(),
+	}
+
+	return fake, server
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var obj map[string]interface{}
+	if len(body) > 0 {
+		json.Unmarshal(body, &obj)
+	}
+
+	path := r.URL.Path
+	existing, exists := f.objects[path]
+
+	switch r.Method {
+	case "GET":
+		if !exists {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(existing)
+
+	case "POST":
+		name := obj["metadata"].(map[string]interface{})["name"].(string)
+		path += "/" + name
+		if _, ok := f.objects[path]; ok {
+			w.WriteHeader(409)
+			return
+		}
+		f.store(path, obj)
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(obj)
+
+	case "PUT":
+		if !exists {
+			w.WriteHeader(404)
+			return
+		}
+		metadata := obj["metadata"].(map[string]interface{})
+		if metadata["resourceVersion"] != existing["metadata"].(map[string]interface{})["resourceVersion"] {
+			w.WriteHeader(409)
+			return
+		}
+		f.store(path, obj)
+		json.NewEncoder(w).Encode(obj)
+
+	case "PATCH":
+		if !exists {
+			w.WriteHeader(404)
+			return
+		}
+		mergePatch(existing, obj)
+		f.store(path, existing)
+		json.NewEncoder(w).Encode(existing)
+
+	case "DELETE":
+		if !exists {
+			w.WriteHeader(404)
+			return
+		}
+		delete(f.objects, path)
+		w.WriteHeader(200)
+	}
+}
+
+// store - saves obj at path with a new resourceVersion
+func (f *fakeKubernetes) store(path string, obj map[string]interface{}) {
+	f.version++
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = strconv.Itoa(f.version)
+	f.objects[path] = obj
+}
+
+// get - returns the stored object at path
+func (f *fakeKubernetes) get(path string) map[string]interface{} {
+	f.Lock()
+	defer f.Unlock()
+	return f.objects[path]
+}
+
+// list - returns the paths of stored objects starting with prefix
+func (f *fakeKubernetes) list(prefix string) []string {
+	f.Lock()
+	defer f.Unlock()
+
+	var paths []string
+	for path := range f.objects {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// mergePatch - applies a JSON merge patch to dst
+func mergePatch(dst, patch map[string]interface{}) {
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(dst, k)
+		case map[string]interface{}:
+			d, ok := dst[k].(map[string]interface{})
+			if !ok {
+				d = map[string]interface{}{}
+				dst[k] = d
+			}
+			mergePatch(d, v)
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+func TestKubernetesKeyStoreSave(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	path := "/api/v1/namespaces/vault/secrets/" + vaultSecretName
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName, rootTokenNamespace: "vault-admin"}
+	tokens := VaultToken{RootToken: "s.root", Tokens: []string{"key-a", "key-b"}, VaultVersion: "1.4.2"}
+
+	if err := store.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := fake.get(path)
+	if secret == nil {
+		t.Fatal("expected the secret to be created")
+	}
+	if _, ok := secret["data"].(map[string]interface{})["root-token"]; ok {
+		t.Fatal("expected the root token to be kept out of the key secret")
+	}
+	metadata := secret["metadata"].(map[string]interface{})
+	if metadata["labels"].(map[string]interface{})["app.kubernetes.io/managed-by"] != "vault-init" {
+		t.Fatalf("expected the managed-by label, got %v", metadata["labels"])
+	}
+	if metadata["annotations"].(map[string]interface{})["vault-init/secret-shares"] != "2" {
+		t.Fatalf("expected the secret-shares annotation, got %v", metadata["annotations"])
+	}
+	if metadata["annotations"].(map[string]interface{})["vault-init/vault-version"] != "1.4.2" {
+		t.Fatalf("expected the vault-version annotation, got %v", metadata["annotations"])
+	}
+
+	if fake.get("/api/v1/namespaces/vault-admin/secrets/"+rootTokenSecretName) == nil {
+		t.Fatal("expected the root token secret to be created in its own namespace")
+	}
+
+	rootToken, err := store.LoadRootToken()
+	if err != nil || rootToken != "s.root" {
+		t.Fatalf("expected the root token, got %q %v", rootToken, err)
+	}
+
+	if err := store.Save(tokens); err != nil {
+		t.Fatalf("saving the same keys again should succeed, got %s", err)
+	}
+
+	rotated := VaultToken{RootToken: "s.other", Tokens: []string{"key-c", "key-d"}}
+	if err := store.Save(rotated); err == nil {
+		t.Fatal("expected saving different keys without force to fail")
+	}
+
+	store.force = true
+	if err := store.Save(rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	backups := fake.list(path + "-backup-")
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup secret, got %v", backups)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RootToken != "" || strings.Join(loaded.Tokens, ",") != "key-c,key-d" {
+		t.Fatalf("expected only the rotated keys, got %+v", loaded)
+	}
+}
+
+func TestNewKubernetesKeyStoreSecretMetadata(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+	defer os.Unsetenv("SECRET_LABELS")
+	defer os.Unsetenv("SECRET_ANNOTATIONS")
+	defer os.Unsetenv("SECRET_OWNER_STATEFULSET")
+
+	// Mistakes are reported at startup, before vault is initialized
+	os.Setenv("SECRET_LABELS", "team")
+	if _, err := NewKubernetesKeyStore(); err == nil || !strings.Contains(err.Error(), "SECRET_LABELS") {
+		t.Fatalf("expected an invalid SECRET_LABELS to be refused, got %v", err)
+	}
+
+	os.Setenv("SECRET_LABELS", "team=platform")
+	os.Setenv("SECRET_ANNOTATIONS", "owner=ops")
+	os.Setenv("SECRET_OWNER_STATEFULSET", "vault")
+	if _, err := NewKubernetesKeyStore(); err == nil || !strings.Contains(err.Error(), "SECRET_OWNER_STATEFULSET") {
+		t.Fatalf("expected a missing StatefulSet to be refused, got %v", err)
+	}
+
+	fake.objects["/apis/apps/v1/namespaces/vault/statefulsets/vault"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "vault", "uid": "1234"},
+	}
+	ks, err := NewKubernetesKeyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := ks.(*KubernetesKeyStore)
+
+	path := "/api/v1/namespaces/vault/secrets/" + vaultSecretName
+	if err := store.Save(VaultToken{Tokens: []string{"key-a", "key-b"}, Threshold: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := fake.get(path)["metadata"].(map[string]interface{})
+	annotations := metadata["annotations"].(map[string]interface{})
+	if metadata["labels"].(map[string]interface{})["team"] != "platform" || annotations["owner"] != "ops" {
+		t.Fatalf("expected the configured labels and annotations, got %v", metadata)
+	}
+	if owners := metadata["ownerReferences"].([]interface{}); len(owners) != 1 || owners[0].(map[string]interface{})["uid"] != "1234" {
+		t.Fatalf("expected the StatefulSet as owner, got %v", metadata["ownerReferences"])
+	}
+	if annotations["vault-init/secret-threshold"] != "2" {
+		t.Fatalf("expected the threshold of the init request, got %v", annotations)
+	}
+
+	// A rekey keeps the initialization time and records the threshold it asked for
+	annotations["vault-init/initialized-at"] = "2020-01-02T03:04:05Z"
+	if err := store.Rotate(VaultToken{Tokens: []string{"key-c", "key-d", "key-e"}, Threshold: 3}, "20200102-030405"); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations = fake.get(path)["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if annotations["vault-init/initialized-at"] != "2020-01-02T03:04:05Z" {
+		t.Fatalf("expected the initialization time to be kept, got %v", annotations)
+	}
+	if annotations["vault-init/secret-shares"] != "3" || annotations["vault-init/secret-threshold"] != "3" {
+		t.Fatalf("expected the shares and threshold of the rekey, got %v", annotations)
+	}
+}
+
+func TestKubernetesKeyStoreSaveEncrypted(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	path := "/api/v1/namespaces/vault/secrets/" + vaultSecretName
+	backend := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName, force: true}
+	store := NewEncryptedKeyStore(backend, newTestFileKeyWrapper(t, "0123456789abcdef0123456789abcdef"))
+	tokens := VaultToken{RootToken: "s.root", Tokens: []string{"key-a", "key-b"}}
+
+	if err := store.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+	stored := fake.get(path)["data"].(map[string]interface{})["key1"]
+
+	// Every save encrypts with a new data key, yet the same keys must not be mistaken for different ones
+	if err := store.Save(tokens); err != nil {
+		t.Fatal(err)
+	}
+	if backups := fake.list(path + "-backup-"); len(backups) != 0 {
+		t.Fatalf("expected no backup when saving the same keys, got %v", backups)
+	}
+	if backups := fake.list("/api/v1/namespaces/vault/secrets/" + rootTokenSecretName + "-backup-"); len(backups) != 0 {
+		t.Fatalf("expected no backup when saving the same root token, got %v", backups)
+	}
+	if fake.get(path)["data"].(map[string]interface{})["key1"] != stored {
+		t.Fatal("expected the stored envelope to be kept")
+	}
+
+	if err := store.Save(VaultToken{RootToken: "s.root", Tokens: []string{"key-c", "key-d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if backups := fake.list(path + "-backup-"); len(backups) != 1 {
+		t.Fatalf("expected one backup when saving different keys, got %v", backups)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(loaded.Tokens, ",") != "key-c,key-d" {
+		t.Fatalf("expected the new keys, got %+v", loaded)
+	}
+}
+
+func TestInitializeVaultStaleRootToken(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault := &fakeVault{name: "vault-0", sealed: true}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	// A root token secret outlived the keys of an earlier initialization
+	rootPath := "/api/v1/namespaces/vault/secrets/" + rootTokenSecretName
+	fake.store(rootPath, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": rootTokenSecretName},
+		"data":     map[string]interface{}{"root-token": base64.StdEncoding.EncodeToString([]byte("s.stale"))},
+	})
+
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+	tokens, ok := initializeVault(logger, "vault-0", &VaultClient{Addr: vaultServer.URL}, store, nil)
+	if !ok || tokens.RootToken != "s.vault-0" {
+		t.Fatalf("expected vault to be initialized and its keys saved, got %+v %v", tokens, ok)
+	}
+
+	rootToken, err := store.LoadRootToken()
+	if err != nil || rootToken != "s.vault-0" {
+		t.Fatalf("expected the new root token to be stored, got %q %v", rootToken, err)
+	}
+	if backups := fake.list(rootPath + "-backup-"); len(backups) != 1 {
+		t.Fatalf("expected the stale root token to be backed up, got %v", backups)
+	}
+}
+
+func TestSaveSecret(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	path := "/api/v1/namespaces/vault/secrets/vault-tokens"
+	original := newSecret("vault-tokens", K8sSecrets{"key1": "YQ=="})
+	original.Metadata.Labels = map[string]string{"team": "platform"}
+
+	if err := saveSecret(original, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.get(path) == nil {
+		t.Fatal("expected the missing secret to be created")
+	}
+
+	if err := saveSecret(original, false); err != nil {
+		t.Fatalf("expected saving the same data to succeed, got %v", err)
+	}
+
+	replacement := newSecret("vault-tokens", K8sSecrets{"key1": "Yg=="})
+	if err := saveSecret(replacement, false); err == nil || !strings.Contains(err.Error(), "FORCE_OVERWRITE") {
+		t.Fatalf("expected different data to be refused without force, got %v", err)
+	}
+	if fake.get(path)["data"].(map[string]interface{})["key1"] != "YQ==" {
+		t.Fatal("expected the refused save to leave the secret untouched")
+	}
+
+	if err := saveSecret(replacement, true); err != nil {
+		t.Fatal(err)
+	}
+	if fake.get(path)["data"].(map[string]interface{})["key1"] != "Yg==" {
+		t.Fatal("expected the forced save to replace the data")
+	}
+
+	backups := fake.list(path + "-backup-")
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v", backups)
+	}
+	backup := fake.get(backups[0])
+	if backup["data"].(map[string]interface{})["key1"] != "YQ==" {
+		t.Fatalf("expected the backup to hold the replaced data, got %v", backup["data"])
+	}
+	if backup["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["team"] != "platform" {
+		t.Fatalf("expected the backup to keep the labels of the replaced secret, got %v", backup["metadata"])
+	}
+}
+
+func TestPutSecretConflict(t *testing.T) {
+	_, server := newFakeKubernetes()
+	defer server.Close()
+
+	secret := newSecret("vault-tokens", K8sSecrets{"key1": "YQ=="})
+	if err := postSecret(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := postSecret(secret); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected a second create to be refused, got %v", err)
+	}
+
+	// A resourceVersion read before another writer changed the secret is rejected
+	secret.Metadata.ResourceVersion = "0"
+	if err := putSecret(secret); err == nil || !strings.Contains(err.Error(), "modified concurrently") {
+		t.Fatalf("expected a stale update to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// KeyStore persists the root token and unseal keys returned by Initialize
+type KeyStore interface {
+	// Save stores the root token and unseal keys
+	Save(tokens VaultToken) error
+
+	// Load returns the stored root token and unseal keys
+	Load() (VaultToken, error)
+
+	// Exists reports whether keys have already been stored
+	Exists() (bool, error)
+
+	// Delete removes the stored root token and unseal keys
+	Delete() error
+}
+
+// keyStores maps KEY_STORE values to the constructor of each backend
+var keyStores = map[string]func() (KeyStore, error){
+	"kubernetes": NewKubernetesKeyStore,
+	"gcs":        NewGCSKeyStore,
+}
+
+// NewKeyStore - creates the key store selected by KEY_STORE (defaults to kubernetes), encrypted when a key-encryption key is configured
+// and decrypting the auto-unseal shares when the keys are PGP encrypted
+func NewKeyStore() (KeyStore, error) {
+	name := os.Getenv("KEY_STORE")
+	if name == "" {
+		name = "kubernetes"
+	}
+
+	create, ok := keyStores[name]
+	if !ok {
+		var names []string
+		for n := range keyStores {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown KEY_STORE %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+
+	store, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper, err := NewKeyWrapper()
+	if err != nil {
+		return nil, err
+	}
+
+	if wrapper != nil {
+		previous, err := NewPreviousKeyWrappers()
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted := NewEncryptedKeyStore(store, wrapper, previous...)
+		if encrypted.AllowPlaintext, err = allowPlaintext(); err != nil {
+			return nil, err
+		}
+		store = encrypted
+	}
+
+	if PGPKeys != nil && len(PGPKeys.Keys) > 0 {
+		store = NewPGPKeyStore(store, PGPKeys)
+	}
+
+	return store, nil
+}
+
+// RootTokenStore is implemented by key stores that can save and load the root token on its own
+type RootTokenStore interface {
+	// SaveRootToken stores token in place of the current root token, leaving the keys untouched
+	SaveRootToken(token string) error
+
+	// LoadRootToken returns the stored root token
+	LoadRootToken() (string, error)
+}
+
+// rootTokenStore - returns store as a RootTokenStore, failing if the backend can not store the root token on its own
+func rootTokenStore(store KeyStore) (RootTokenStore, error) {
+	rootStore, ok := store.(RootTokenStore)
+	if !ok {
+		return nil, fmt.Errorf("%T can not store the root token on its own", store)
+	}
+	return rootStore, nil
+}
+
+// KeyRotator is implemented by key stores that can replace the stored keys while keeping the old ones as a backup, as a rekey needs
+type KeyRotator interface {
+	// Rotate backs up the stored keys under version, then stores tokens in their place
+	Rotate(tokens VaultToken, version string) error
+
+	// Restore puts the keys backed up under version back in place and removes the backup
+	Restore(version string) error
+
+	// DeleteBackup removes the keys backed up under version
+	DeleteBackup(version string) error
+}
+
+// keyRotator - returns store as a KeyRotator, failing if the backend can not keep backups
+func keyRotator(store KeyStore) (KeyRotator, error) {
+	rotator, ok := store.(KeyRotator)
+	if !ok {
+		return nil, fmt.Errorf("%T can not back up keys", store)
+	}
+	return rotator, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// memoryKeyStore keeps tokens in memory for tests
+type memoryKeyStore struct {
+	tokens *VaultToken
+}
+
+func (s *memoryKeyStore) Save(tokens VaultToken) error {
+	s.tokens = &tokens
+	return nil
+}
+
+func (s *memoryKeyStore) Load() (VaultToken, error) {
+	if s.tokens == nil {
+		return VaultToken{}, os.ErrNotExist
+	}
+	return *s.tokens, nil
+}
+
+func (s *memoryKeyStore) Exists() (bool, error) {
+	return s.tokens != nil, nil
+}
+
+func (s *memoryKeyStore) Delete() error {
+	s.tokens = nil
+	return nil
+}
+
+func TestNewKeyStoreUnknown(t *testing.T) {
+	os.Setenv("KEY_STORE", "floppy")
+	defer os.Unsetenv("KEY_STORE")
+
+	if _, err := NewKeyStore(); err == nil {
+		t.Fatal("expected an error for an unknown KEY_STORE")
+	}
+}
+
+func TestNewKeyStore(t *testing.T) {
+	os.Unsetenv("KEY_STORE")
+
+	store, err := NewKeyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k8s, ok := store.(*KubernetesKeyStore); !ok || k8s.rootTokenSecret != rootTokenSecretName {
+		t.Fatalf("expected the kubernetes key store by default, got %#v", store)
+	}
+
+	memory := &memoryKeyStore{}
+	keyStores["memory"] = func() (KeyStore, error) { return memory, nil }
+	defer delete(keyStores, "memory")
+
+	os.Setenv("KEY_STORE", "memory")
+	defer os.Unsetenv("KEY_STORE")
+
+	store, err = NewKeyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store != memory {
+		t.Fatalf("expected the backend named by KEY_STORE, got %#v", store)
+	}
+}
+
+func TestOptionalKeyStoreInterfaces(t *testing.T) {
+	if _, err := rootTokenStore(&memoryKeyStore{}); err == nil {
+		t.Fatal("expected a store without SaveRootToken to be refused")
+	}
+	if _, err := keyRotator(&memoryKeyStore{}); err == nil {
+		t.Fatal("expected a store without Rotate to be refused")
+	}
+
+	if _, err := rootTokenStore(&KubernetesKeyStore{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyRotator(&KubernetesKeyStore{}); err != nil {
+		t.Fatal(err)
+	}
+}
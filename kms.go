@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/oauth2/google"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// newKMSService - creates a Cloud KMS client using the default Google credentials
+func newKMSService(ctx context.Context) (*cloudkms.Service, error) {
+	client, err := google.DefaultClient(ctx, cloudkms.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not create google client: %s", err)
+	}
+
+	return cloudkms.New(client)
+}
+
+// kmsEncrypt - encrypts plaintext with the given Cloud KMS key
+func kmsEncrypt(ctx context.Context, kms *cloudkms.Service, keyID string, plaintext []byte) ([]byte, error) {
+	encryptRequest := &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}
+
+	encryptResponse, err := kms.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyID, encryptRequest).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(encryptResponse.Ciphertext)
+}
+
+// kmsDecrypt - decrypts ciphertext produced by kmsEncrypt with the same Cloud KMS key
+func kmsDecrypt(ctx context.Context, kms *cloudkms.Service, keyID string, ciphertext []byte) ([]byte, error) {
+	decryptRequest := &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+
+	decryptResponse, err := kms.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyID, decryptRequest).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(decryptResponse.Plaintext)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the token, CA and namespace mounted into every pod
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// kubectlProxyURL is used when running outside a cluster without a kubeconfig
+	kubectlProxyURL = "http://localhost:8001"
+
+	// kubernetesTimeout bounds every request to the API server, so a hung server can not stall the check loop
+	kubernetesTimeout = 30 * time.Second
+)
+
+// kubeClient is the Kubernetes API client used by vault-init, set up by main
+var kubeClient *KubernetesClient
+
+// KubernetesClient sends authenticated requests to a Kubernetes API server
+type KubernetesClient struct {
+	// Host is the base URL of the API server
+	Host string
+
+	// Namespace is the namespace vault-init manages secrets in
+	Namespace string
+
+	token     string
+	tokenFile string
+	username  string
+	password  string
+	client    *http.Client
+}
+
+// NewKubernetesClient - creates a client from KUBECONFIG, the in-cluster service account, ~/.kube/config or kubectl proxy, in that order
+func NewKubernetesClient() (*KubernetesClient, error) {
+	var c *KubernetesClient
+	var err error
+
+	kubeconfig := os.Getenv("KUBECONFIG")
+	home := filepath.Join(os.Getenv("HOME"), ".kube", "config")
+
+	switch {
+	case kubeconfig != "":
+		// Merging multiple kubeconfig files is not supported, the first one is used
+		c, err = NewKubeconfigClient(filepath.SplitList(kubeconfig)[0], os.Getenv("KUBECONTEXT"))
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != "":
+		c, err = NewInClusterClient()
+	case fileExists(home):
+		c, err = NewKubeconfigClient(home, os.Getenv("KUBECONTEXT"))
+	default:
+		logger.Infof("No kubeconfig or service account found, using kubectl proxy at %s", kubectlProxyURL)
+		c = &KubernetesClient{
+			Host:   kubectlProxyURL,
+			client: &http.Client{Timeout: kubernetesTimeout},
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace := os.Getenv("KUBERNETES_NAMESPACE"); namespace != "" {
+		c.Namespace = namespace
+	}
+
+	if c.Namespace == "" {
+		c.Namespace = "default"
+	}
+
+	return c, nil
+}
+
+// NewInClusterClient - creates a client from the service account mounted into the pod - needs correct RBAC permissions
+func NewInClusterClient() (*KubernetesClient, error) {
+	caCertPool := x509.NewCertPool()
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA: %s", err)
+	}
+	caCertPool.AppendCertsFromPEM(caCert)
+
+	c := &KubernetesClient{
+		Host:      "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT"),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client: &http.Client{
+			Timeout: kubernetesTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: caCertPool,
+				},
+			},
+		},
+	}
+
+	if namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		c.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	return c, nil
+}
+
+// Do - sends a request to the API server, url being either absolute or a path such as /api/v1/namespaces
+func (c *KubernetesClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return c.do(method, url, "application/json", body)
+}
+
+// Patch - sends a JSON merge patch to the API server
+func (c *KubernetesClient) Patch(url string, patch interface{}) (*http.Response, error) {
+	b := toJSON(patch)
+	return c.do("PATCH", url, "application/merge-patch+json", &b)
+}
+
+// do - sends a request with a body of contentType to the API server
+func (c *KubernetesClient) do(method, url, contentType string, body io.Reader) (*http.Response, error) {
+	if strings.HasPrefix(url, "/") {
+		url = c.Host + url
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	token := c.token
+	if c.tokenFile != "" {
+		// The token is read on every request as projected service account tokens are rotated
+		b, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read kubernetes token: %s", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	switch {
+	case token != "":
+		registerSecrets(token)
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.username != "":
+		registerSecrets(c.password)
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	start := time.Now()
+	res, err := c.client.Do(req)
+	kubernetesRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+
+	return res, err
+}
+
+// fileExists - reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
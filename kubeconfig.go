@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Kubeconfig holds the parts of a kubeconfig file vault-init understands
+type Kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string            `json:"name"`
+		Cluster KubeconfigCluster `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string            `json:"name"`
+		Context KubeconfigContext `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string         `json:"name"`
+		User KubeconfigUser `json:"user"`
+	} `json:"users"`
+}
+
+// KubeconfigCluster holds the address and CA of an API server
+type KubeconfigCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+	TLSServerName            string `json:"tls-server-name"`
+}
+
+// KubeconfigContext ties a cluster to a user and default namespace
+type KubeconfigContext struct {
+	Cluster   string `json:"cluster"`
+	User      string `json:"user"`
+	Namespace string `json:"namespace"`
+}
+
+// KubeconfigUser holds the credentials of a user
+type KubeconfigUser struct {
+	ClientCertificate     string      `json:"client-certificate"`
+	ClientCertificateData []byte      `json:"client-certificate-data"`
+	ClientKey             string      `json:"client-key"`
+	ClientKeyData         []byte      `json:"client-key-data"`
+	Token                 string      `json:"token"`
+	TokenFile             string      `json:"tokenFile"`
+	Username              string      `json:"username"`
+	Password              string      `json:"password"`
+	Exec                  interface{} `json:"exec"`
+	AuthProvider          interface{} `json:"auth-provider"`
+}
+
+// NewKubeconfigClient - creates a client for contextName (or the current context) of the kubeconfig file at path
+func NewKubeconfigClient(path, contextName string) (*KubernetesClient, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read kubeconfig: %s", err)
+	}
+
+	var config Kubeconfig
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("could not parse kubeconfig %s: %s", path, err)
+	}
+
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no current-context", path)
+	}
+
+	var context *KubeconfigContext
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == contextName {
+			context = &config.Contexts[i].Context
+		}
+	}
+	if context == nil {
+		return nil, fmt.Errorf("kubeconfig %s has no context %q", path, contextName)
+	}
+
+	var cluster *KubeconfigCluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == context.Cluster {
+			cluster = &config.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no cluster %q", path, context.Cluster)
+	}
+
+	user := &KubeconfigUser{}
+	for i := range config.Users {
+		if config.Users[i].Name == context.User {
+			user = &config.Users[i].User
+		}
+	}
+
+	if user.Exec != nil || user.AuthProvider != nil {
+		return nil, fmt.Errorf("kubeconfig user %q uses an exec or auth-provider plugin, which is not supported", context.User)
+	}
+
+	dir := filepath.Dir(path)
+
+	tlsConfig, err := kubeconfigTLSConfig(dir, cluster, user)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &KubernetesClient{
+		Host:      strings.TrimSuffix(cluster.Server, "/"),
+		Namespace: context.Namespace,
+		token:     user.Token,
+		username:  user.Username,
+		password:  user.Password,
+		client: &http.Client{
+			Timeout: kubernetesTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+
+	if user.TokenFile != "" {
+		c.tokenFile = resolveKubeconfigPath(dir, user.TokenFile)
+	}
+
+	return c, nil
+}
+
+// kubeconfigTLSConfig - builds the TLS configuration for a cluster and user
+func kubeconfigTLSConfig(dir string, cluster *KubeconfigCluster, user *KubeconfigUser) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+		ServerName:         cluster.TLSServerName,
+	}
+
+	caCert, err := kubeconfigData(dir, cluster.CertificateAuthorityData, cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("could not read certificate-authority: %s", err)
+	}
+	if caCert != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("certificate-authority holds no PEM certificates")
+		}
+	}
+
+	cert, err := kubeconfigData(dir, user.ClientCertificateData, user.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client-certificate: %s", err)
+	}
+
+	key, err := kubeconfigData(dir, user.ClientKeyData, user.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client-key: %s", err)
+	}
+
+	if cert != nil || key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsConfig, nil
+}
+
+// kubeconfigData - returns inline data if set, otherwise the contents of file
+func kubeconfigData(dir string, data []byte, file string) ([]byte, error) {
+	if len(data) > 0 {
+		return data, nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(resolveKubeconfigPath(dir, file))
+}
+
+// resolveKubeconfigPath - resolves paths relative to the directory of the kubeconfig file, as kubectl does
+func resolveKubeconfigPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
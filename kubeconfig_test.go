@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewKubeconfigClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer from-file" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0600)
+
+	config := `apiVersion: v1
+kind: Config
+current-context: ci
+clusters:
+- cluster:
+    certificate-authority-data: ` + base64.StdEncoding.EncodeToString(caData) + `
+    server: ` + server.URL + `
+  name: test
+- cluster:
+    server: https://unused.example.com
+  name: other
+contexts:
+- context:
+    cluster: test
+    namespace: vault
+    user: ci
+  name: ci
+users:
+- name: ci
+  user:
+    tokenFile: token
+`
+	path := filepath.Join(dir, "config")
+	ioutil.WriteFile(path, []byte(config), 0600)
+
+	c, err := NewKubeconfigClient(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Namespace != "vault" {
+		t.Fatalf("expected namespace vault, got %q", c.Namespace)
+	}
+	if c.client.Timeout != kubernetesTimeout {
+		t.Fatalf("expected requests to time out after %s, got %s", kubernetesTimeout, c.client.Timeout)
+	}
+
+	res, err := c.Do("GET", "/api/v1/namespaces", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "/api/v1/namespaces" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+
+	if _, err := NewKubeconfigClient(path, "missing"); err == nil {
+		t.Fatal("expected an error for a missing context")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// sealedLabel and activeLabel let Services and dashboards select Vault pods by state
+	sealedLabel = "vault-sealed"
+	activeLabel = "vault-active"
+
+	// stateAnnotation holds the full state of the Vault server in the pod
+	stateAnnotation = "vault-init/state"
+)
+
+// podLabeler labels the Vault pods with their state, nil when POD_LABELS is false
+var podLabeler *PodLabeler
+
+// PodLabeler patches the labels of Vault pods when the state of their Vault server changes
+type PodLabeler struct {
+	mu      sync.Mutex
+	applied map[string]VaultState
+}
+
+// NewPodLabeler - creates a labeler, returning nil if POD_LABELS is false
+func NewPodLabeler() (*PodLabeler, error) {
+	if v := os.Getenv("POD_LABELS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("POD_LABELS is invalid: %s", err)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	return &PodLabeler{applied: map[string]VaultState{}}, nil
+}
+
+// Apply - labels the pod with state unless it already was, trying again on the next call after a failure
+func (l *PodLabeler) Apply(namespace, pod string, state VaultState) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := namespace + "/" + pod
+	if applied, ok := l.applied[key]; ok && applied == state {
+		return
+	}
+
+	// An uninitialized vault is sealed too
+	sealed := state == StateSealed || state == StateUninitialized
+	active := state == StateActive
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				sealedLabel: strconv.FormatBool(sealed),
+				activeLabel: strconv.FormatBool(active),
+			},
+			"annotations": map[string]string{
+				stateAnnotation: string(state),
+			},
+		},
+	}
+
+	res, err := kubeClient.Patch("/api/v1/namespaces/"+namespace+"/pods/"+pod, patch)
+	if err != nil {
+		logger.Warnf("Could not label pod %s: %s", pod, err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 {
+		logger.Warnf("Could not label pod %s: non 200 status code: %d", pod, res.StatusCode)
+		return
+	}
+
+	l.applied[key] = state
+}
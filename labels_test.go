@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestPodLabeler(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	const path = "/api/v1/namespaces/vault/pods/vault-0"
+	fake.objects[path] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "vault-0", "labels": map[string]interface{}{"app": "vault"}},
+	}
+
+	labeler, err := NewPodLabeler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := func() map[string]interface{} {
+		return fake.get(path)["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	}
+
+	labeler.Apply("vault", "vault-0", StateSealed)
+	if l := labels(); l[sealedLabel] != "true" || l[activeLabel] != "false" || l["app"] != "vault" {
+		t.Fatalf("expected a sealed, inactive pod keeping its labels, got %v", l)
+	}
+
+	// The same state is not patched again
+	labels()[sealedLabel] = "unchanged"
+	labeler.Apply("vault", "vault-0", StateSealed)
+	if l := labels(); l[sealedLabel] != "unchanged" {
+		t.Fatalf("expected no patch without a transition, got %v", l)
+	}
+
+	labeler.Apply("vault", "vault-0", StateActive)
+	if l := labels(); l[sealedLabel] != "false" || l[activeLabel] != "true" {
+		t.Fatalf("expected an unsealed, active pod, got %v", l)
+	}
+
+	annotations := fake.get(path)["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if annotations[stateAnnotation] != "active" {
+		t.Fatalf("expected the state annotation, got %v", annotations)
+	}
+}
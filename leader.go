@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// leaseTimeFormat is the MicroTime format the Kubernetes API uses for lease timestamps
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// LeaderElector uses a Kubernetes Lease so only one vault-init replica initializes Vault
+type LeaderElector struct {
+	// Name and Namespace locate the lease
+	Name      string
+	Namespace string
+
+	// Identity is recorded as the lease holder, normally the pod name
+	Identity string
+
+	// Duration is how long the lease is held without being renewed
+	Duration time.Duration
+}
+
+// NewLeaderElector - creates an elector from LEASE_NAME, LEASE_DURATION and POD_NAME, returning nil if LEADER_ELECTION is false
+func NewLeaderElector() (*LeaderElector, error) {
+	if v := os.Getenv("LEADER_ELECTION"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("LEADER_ELECTION is invalid: %s", err)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	l := &LeaderElector{
+		Name:      os.Getenv("LEASE_NAME"),
+		Namespace: kubeClient.Namespace,
+		Identity:  os.Getenv("POD_NAME"),
+		Duration:  15 * time.Second,
+	}
+
+	if l.Name == "" {
+		l.Name = "vault-init"
+	}
+
+	if l.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("POD_NAME is not set and the hostname is unknown: %s", err)
+		}
+		l.Identity = hostname
+	}
+
+	if v := os.Getenv("LEASE_DURATION"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("LEASE_DURATION is invalid: %q", v)
+		}
+		l.Duration = time.Duration(seconds) * time.Second
+	}
+
+	return l, nil
+}
+
+// TryAcquire - acquires or renews the lease, reporting whether this replica holds it
+func (l *LeaderElector) TryAcquire() (bool, error) {
+	lease, err := l.get()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	if lease.Metadata.ResourceVersion == "" {
+		lease = Lease{
+			Kind:       "Lease",
+			APIVersion: "coordination.k8s.io/v1",
+			Metadata: MetaData{
+				Name:      l.Name,
+				Namespace: l.Namespace,
+			},
+		}
+		l.hold(&lease, now)
+		return l.write("POST", l.url(), lease)
+	}
+
+	if lease.Spec.HolderIdentity != l.Identity {
+		if !l.expired(lease, now) {
+			return false, nil
+		}
+
+		logger.Infof("Lease %s held by %q expired, taking it over", l.Name, lease.Spec.HolderIdentity)
+		lease.Spec.LeaseTransitions++
+		lease.Spec.AcquireTime = ""
+	}
+
+	l.hold(&lease, now)
+	return l.write("PUT", l.url()+"/"+l.Name, lease)
+}
+
+// Release - gives up the lease if this replica holds it, so another replica does not have to wait for it to expire
+func (l *LeaderElector) Release() error {
+	lease, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity != l.Identity {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.AcquireTime = ""
+	lease.Spec.RenewTime = ""
+
+	_, err = l.write("PUT", l.url()+"/"+l.Name, lease)
+	return err
+}
+
+// Renew - keeps renewing the lease every third of its duration until the returned function is called,
+// so a long initialization does not let another replica take the lease over while it is still running
+func (l *LeaderElector) Renew(log *Logger) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(l.Duration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				leader, err := l.TryAcquire()
+				if err != nil {
+					log.Warnf("Could not renew lease %s: %s", l.Name, err)
+				} else if !leader {
+					log.Warnf("Lease %s was taken over by another replica", l.Name)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// hold - records this replica as the holder of the lease
+func (l *LeaderElector) hold(lease *Lease, now time.Time) {
+	lease.Spec.HolderIdentity = l.Identity
+	lease.Spec.LeaseDurationSeconds = int(l.Duration / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+	if lease.Spec.AcquireTime == "" {
+		lease.Spec.AcquireTime = lease.Spec.RenewTime
+	}
+}
+
+// expired - reports whether the holder of the lease stopped renewing it
+func (l *LeaderElector) expired(lease Lease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == "" {
+		return true
+	}
+
+	renewed, err := time.Parse(leaseTimeFormat, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	return now.After(renewed.Add(duration))
+}
+
+// get - retrieves the lease, returning an empty lease if it does not exist
+func (l *LeaderElector) get() (Lease, error) {
+	target := Lease{}
+
+	res, err := kubernetesRequest("GET", l.url()+"/"+l.Name, nil)
+	if err != nil {
+		return target, err
+	}
+	defer res.Body.Close()
+
+	k8sResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return target, err
+	}
+
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return target, nil
+	default:
+		return target, fmt.Errorf("get lease %s: non 200 status code: %d", l.Name, res.StatusCode)
+	}
+
+	if err := json.Unmarshal(k8sResponse, &target); err != nil {
+		return target, fmt.Errorf("get lease %s: %s", l.Name, err)
+	}
+	return target, nil
+}
+
+// write - creates or updates the lease, reporting false if another replica changed it first
+func (l *LeaderElector) write(method, url string, lease Lease) (bool, error) {
+	b := toJSON(lease)
+
+	res, err := kubernetesRequest(method, url, &b)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200, 201:
+		return true, nil
+	case 409:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s lease %s: unexpected status code: %d", method, l.Name, res.StatusCode)
+	}
+}
+
+// url - formats the URL to access leases
+func (l *LeaderElector) url() string {
+	return kubeClient.Host + "/apis/coordination.k8s.io/v1/namespaces/" + l.Namespace + "/leases"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaderElector(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault0 := &LeaderElector{Name: "vault-init", Namespace: "vault", Identity: "vault-0", Duration: time.Minute}
+	vault1 := &LeaderElector{Name: "vault-init", Namespace: "vault", Identity: "vault-1", Duration: time.Minute}
+
+	if leader, err := vault0.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-0 to acquire the lease, got %v %v", leader, err)
+	}
+
+	if leader, err := vault1.TryAcquire(); err != nil || leader {
+		t.Fatalf("expected vault-1 to be refused the lease, got %v %v", leader, err)
+	}
+
+	if leader, err := vault0.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-0 to renew the lease, got %v %v", leader, err)
+	}
+
+	// Let the lease held by vault-0 expire
+	lease := fake.get("/apis/coordination.k8s.io/v1/namespaces/vault/leases/vault-init")
+	lease["spec"].(map[string]interface{})["renewTime"] = time.Now().Add(-2 * time.Minute).UTC().Format(leaseTimeFormat)
+
+	if leader, err := vault1.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-1 to take over the expired lease, got %v %v", leader, err)
+	}
+
+	if err := vault1.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if leader, err := vault0.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-0 to acquire the released lease, got %v %v", leader, err)
+	}
+}
+
+func TestLeaderElectorRenew(t *testing.T) {
+	_, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault0 := &LeaderElector{Name: "vault-init", Namespace: "vault", Identity: "vault-0", Duration: time.Second}
+	vault1 := &LeaderElector{Name: "vault-init", Namespace: "vault", Identity: "vault-1", Duration: time.Second}
+
+	if leader, err := vault0.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-0 to acquire the lease, got %v %v", leader, err)
+	}
+
+	// Outlast the lease duration while vault-0 keeps renewing it
+	stop := vault0.Renew(logger)
+	time.Sleep(1500 * time.Millisecond)
+
+	if leader, err := vault1.TryAcquire(); err != nil || leader {
+		t.Fatalf("expected vault-1 to be refused the renewed lease, got %v %v", leader, err)
+	}
+
+	stop()
+	time.Sleep(1500 * time.Millisecond)
+
+	if leader, err := vault1.TryAcquire(); err != nil || !leader {
+		t.Fatalf("expected vault-1 to take over once renewing stopped, got %v %v", leader, err)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record
+type Level int
+
+// Log levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{LevelDebug: "debug", LevelInfo: "info", LevelWarn: "warn", LevelError: "error"}
+
+// Fields are the key value pairs logged with a record, such as vault_addr, state, attempt and duration
+type Fields map[string]interface{}
+
+// logger is used by every part of vault-init, and by the standard log package through logger.Write
+var logger = &Logger{out: os.Stderr, format: "logfmt", level: LevelInfo, mu: &sync.Mutex{}}
+
+// Logger writes leveled records with fields as logfmt or JSON, passing everything through redact first
+type Logger struct {
+	out    io.Writer
+	format string
+	level  Level
+	fields Fields
+
+	// mu is shared with the loggers returned by With, so their records never interleave
+	mu *sync.Mutex
+}
+
+// NewLogger - creates a logger writing to out in the LOG_FORMAT format, logfmt or json, from the LOG_LEVEL level
+func NewLogger(out io.Writer) (*Logger, error) {
+	l := &Logger{out: out, format: "logfmt", level: LevelInfo, mu: &sync.Mutex{}}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "logfmt":
+	case "json":
+		l.format = format
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT must be logfmt or json, not %q", format)
+	}
+
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		found := false
+		for level, name := range levelNames {
+			if strings.EqualFold(v, name) {
+				l.level, found = level, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, not %q", v)
+		}
+	}
+
+	return l, nil
+}
+
+// setLogger - replaces logger with one writing to out as configured by LOG_FORMAT and LOG_LEVEL, leaving it untouched if they are invalid
+func setLogger(out io.Writer) error {
+	l, err := NewLogger(out)
+	if err != nil {
+		return err
+	}
+
+	logger = l
+	return nil
+}
+
+// With - returns a logger adding fields to every record
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	child := *l
+	child.fields = merged
+	return &child
+}
+
+// Debugf - logs a debug record
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof - logs an info record
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warnf - logs a warning record
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf - logs an error record
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf - logs an error record and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// Write - logs what the standard log package prints as info records, so nothing bypasses redaction
+func (l *Logger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.log(LevelInfo, line)
+	}
+	return len(p), nil
+}
+
+// log - writes a record unless its level is below the logger's
+func (l *Logger) log(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// time, level and msg come first, then the fields in order
+	names := append([]string{"time", "level", "msg"}, keys...)
+	values := []string{time.Now().UTC().Format(time.RFC3339), levelNames[level], redact(msg)}
+	for _, k := range keys {
+		value := fmt.Sprint(l.fields[k])
+		if ciphertextFields[k] {
+			values = append(values, redactRegistered(value))
+		} else {
+			values = append(values, redact(value))
+		}
+	}
+
+	var b bytes.Buffer
+	if l.format == "json" {
+		b.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			key, _ := json.Marshal(name)
+			value, _ := json.Marshal(values[i])
+			b.Write(key)
+			b.WriteString(":")
+			b.Write(value)
+		}
+		b.WriteString("}\n")
+	} else {
+		for i, name := range names {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(name + "=" + logfmtValue(values[i]))
+		}
+		b.WriteString("\n")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(b.Bytes())
+}
+
+// logfmtValue - quotes value if it is empty or holds spaces, quotes, equals signs or control characters
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\\") || strings.IndexFunc(value, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// secrets are the exact values redacted from every record, registered as they enter the process
+var secrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: map[string]bool{}}
+
+// secretPatterns match secrets that were never registered, such as tokens echoed by an API
+var secretPatterns = []*regexp.Regexp{
+	// Authorization headers
+	regexp.MustCompile(`(?i)\bbearer\s+[^\s"',]+`),
+	// Vault service, batch and recovery tokens, old and new style
+	regexp.MustCompile(`\b(hv[sbr]|[sbr])\.[A-Za-z0-9_-]{20,}`),
+	// JSON web tokens such as service account tokens
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	// Hex unseal and recovery keys
+	regexp.MustCompile(`\b[0-9a-fA-F]{64,}\b`),
+}
+
+// base64Pattern matches base64 unseal and recovery keys, and PGP encrypted ones, along with long URL paths that looksLikeBase64 rules out
+var base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/]{40,}={0,2}`)
+
+// looksLikeBase64 - reports whether s mixes upper and lower case letters and digits, which paths and words rarely do
+func looksLikeBase64(s string) bool {
+	return strings.ContainsAny(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") &&
+		strings.ContainsAny(s, "abcdefghijklmnopqrstuvwxyz") &&
+		strings.ContainsAny(s, "0123456789")
+}
+
+// redacted replaces every secret in a record
+const redacted = "[REDACTED]"
+
+// registerSecrets - makes sure values never appear in the logs
+func registerSecrets(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	for _, value := range values {
+		// Short values would redact ordinary words
+		if len(value) >= 8 {
+			secrets.values[value] = true
+		}
+	}
+}
+
+// registerTokens - registers the root token and every key in tokens
+func registerTokens(tokens VaultToken) {
+	registerSecrets(tokens.RootToken)
+	registerSecrets(tokens.Tokens...)
+	registerSecrets(tokens.RecoveryKeys...)
+	registerSecrets(tokens.RetiredKeys...)
+}
+
+// ciphertextFields hold values encrypted for an operator, which look like keys but are meant to be printed, so only registered secrets are redacted from them
+var ciphertextFields = map[string]bool{"encrypted_root_token": true, "encrypted_key": true}
+
+// redact - replaces registered secrets and anything shaped like a token or key in s
+func redact(s string) string {
+	s = redactRegistered(s)
+
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+
+	return base64Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		if looksLikeBase64(match) {
+			return redacted
+		}
+		return match
+	})
+}
+
+// redactRegistered - replaces the registered secrets in s
+func redactRegistered(s string) string {
+	secrets.RLock()
+	values := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		values = append(values, value)
+	}
+	secrets.RUnlock()
+
+	// Longer secrets first, so one containing another is replaced whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		s = strings.Replace(s, value, redacted, -1)
+	}
+
+	return s
+}
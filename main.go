@@ -10,7 +10,16 @@ import (
 )
 
 func main() {
-	log.Println("Starting the vault-init service...")
+	if err := setLogger(os.Stderr); err != nil {
+		// Reported through the default logger, which is kept when the configured one is invalid
+		logger.Fatalf("Logging is misconfigured: %s", err)
+	}
+
+	// Anything still printed through the standard log package is redacted too
+	log.SetFlags(0)
+	log.SetOutput(logger)
+
+	logger.Infof("Starting the vault-init service...")
 
 	checkInterval := os.Getenv("CHECK_INTERVAL")
 	if checkInterval == "" {
@@ -19,16 +28,140 @@ func main() {
 
 	i, err := strconv.Atoi(checkInterval)
 	if err != nil {
-		log.Fatalf("CHECK_INTERVAL is invalid: %s", err)
+		logger.Fatalf("CHECK_INTERVAL is invalid: %s", err)
 	}
 
 	checkIntervalDuration := time.Duration(i) * time.Second
 
+	if secretShares := os.Getenv("SECRET_SHARES"); secretShares != "" {
+		NumTokens, err = strconv.Atoi(secretShares)
+		if err != nil {
+			logger.Fatalf("SECRET_SHARES is invalid: %s", err)
+		}
+	}
+
+	if secretThreshold := os.Getenv("SECRET_THRESHOLD"); secretThreshold != "" {
+		TokensRequired, err = strconv.Atoi(secretThreshold)
+		if err != nil {
+			logger.Fatalf("SECRET_THRESHOLD is invalid: %s", err)
+		}
+	}
+
+	PGPKeys, err = NewPGPConfig()
+	if err != nil {
+		logger.Fatalf("PGP keys are misconfigured: %s", err)
+	}
+
+	if PGPKeys != nil && len(PGPKeys.Keys) > 0 {
+		// Vault expects one public key per share
+		if os.Getenv("SECRET_SHARES") != "" && NumTokens != len(PGPKeys.Keys) {
+			logger.Fatalf("SECRET_SHARES (%d) does not match the %d PGP keys configured", NumTokens, len(PGPKeys.Keys))
+		}
+		NumTokens = len(PGPKeys.Keys)
+	}
+
+	if NumTokens < 1 || TokensRequired < 1 || TokensRequired > NumTokens {
+		logger.Fatalf("SECRET_THRESHOLD (%d) must be between 1 and SECRET_SHARES (%d)", TokensRequired, NumTokens)
+	}
+
+	if err := configureVaultTLS(); err != nil {
+		logger.Fatalf("Vault TLS is misconfigured: %s", err)
+	}
+	httpClient.Transport = &instrumentedTransport{next: httpClient.Transport, histogram: vaultRequestDuration}
+
+	kubeClient, err = NewKubernetesClient()
+	if err != nil {
+		logger.Fatalf("Could not configure the Kubernetes client: %s", err)
+	}
+
+	events, err = NewEventRecorder()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	podLabeler, err = NewPodLabeler()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	store, err := NewKeyStore()
+	if err != nil {
+		logger.Fatalf("KEY_STORE is invalid: %s", err)
+	}
+
+	elector, err := NewLeaderElector()
+	if err != nil {
+		logger.Fatalf("Leader election is misconfigured: %s", err)
+	}
+
+	bootstrapper, err := NewBootstrapper(store, elector)
+	if err != nil {
+		logger.Fatalf("BOOTSTRAP_CONFIG is invalid: %s", err)
+	}
+
+	raft, err := NewRaftJoiner()
+	if err != nil {
+		logger.Fatalf("Raft join is misconfigured: %s", err)
+	}
+
+	probes, err := NewProbes(checkIntervalDuration)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	probes.AddCheck("storage", func() error {
+		_, err := store.Exists()
+		return err
+	})
+
+	command := "sidecar"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "sidecar":
+		sidecar, err := NewSidecar(store, elector, bootstrapper, raft)
+		if err != nil {
+			logger.Fatalf("Sidecar is misconfigured: %s", err)
+		}
+
+		probes.AddCheck("vault", func() error {
+			_, err := sidecar.vault.Status()
+			return err
+		})
+		serveHTTP(probes)
+
+		run(checkIntervalDuration, probes, sidecar.Check)
+	case "controller":
+		controller, err := NewController(store, elector, bootstrapper, raft)
+		if err != nil {
+			logger.Fatalf("Controller is misconfigured: %s", err)
+		}
+
+		probes.AddCheck("vault", controller.Reachable)
+		serveHTTP(probes)
+
+		run(checkIntervalDuration, probes, controller.Check)
+	case "rekey":
+		if err := NewVaultClient().Rekey(store); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	case "generate-root":
+		if err := generateRoot(NewVaultClient(), store); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	default:
+		logger.Fatalf("Unknown command %q, expected sidecar, controller, rekey or generate-root", command)
+	}
+}
+
+// run - calls check every interval until the process is signalled to stop, reporting progress to probes
+func run(interval time.Duration, probes *Probes, check func()) {
 	//Allow CTRL+C
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	signalCh := make(chan os.Signal)
+	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh,
 		syscall.SIGINT,
 		syscall.SIGTERM,
@@ -36,7 +169,7 @@ func main() {
 	)
 
 	stop := func() {
-		log.Printf("Shutting down")
+		logger.Infof("Shutting down")
 		os.Exit(0)
 	}
 
@@ -49,42 +182,88 @@ func main() {
 		default:
 		}
 
-		response, err := httpClient.Head(GetVaultURL("/v1/sys/health"))
+		// A panicking check is not progress, so /healthz fails if it keeps panicking
+		start := time.Now()
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Errorf("Check failed: %v", r)
+				}
+			}()
+
+			check()
+			probes.Progress()
+		}()
+
+		logger.With(Fields{"duration": time.Since(start).Round(time.Millisecond)}).Debugf("Next check in %s", interval)
 
-		if response != nil && response.Body != nil {
-			response.Body.Close()
+		select {
+		case <-signalCh:
+			stop()
+		case <-time.After(interval):
 		}
+	}
+}
 
+// initializeVault - initializes vault and saves its keys, provided this replica holds the lease when leader election is enabled
+// and no keys are stored yet
+func initializeVault(log *Logger, server string, vault *VaultClient, store KeyStore, elector *LeaderElector) (VaultToken, bool) {
+	if elector != nil {
+		leader, err := elector.TryAcquire()
 		if err != nil {
-			log.Println(err)
-			time.Sleep(checkIntervalDuration)
-			continue
+			log.Errorf("Could not acquire lease %s: %s", elector.Name, err)
+			return VaultToken{}, false
 		}
 
-		switch response.StatusCode {
-		case 200:
-			log.Println("Vault is initialized and unsealed.")
-		case 429:
-			log.Println("Vault is unsealed and in standby mode.")
-		case 501:
-			log.Println("Vault is not initialized. Initializing and unsealing...")
-			vaultResponse := Initialize()
-			log.Print("Initialized!! Saving Tokens")
-			SaveTokens(vaultResponse)
-			Unseal()
-		case 503:
-			log.Println("Vault is sealed. Unsealing...")
-			Unseal()
-		default:
-			log.Printf("Vault is in an unknown state. Status code: %d", response.StatusCode)
+		if !leader {
+			log.Infof("Lease %s is held by another replica, leaving initialization to it", elector.Name)
+			return VaultToken{}, false
 		}
 
-		log.Printf("Next check in %s", checkIntervalDuration)
+		defer func() {
+			if err := elector.Release(); err != nil {
+				log.Warnf("Could not release lease %s: %s", elector.Name, err)
+			}
+		}()
+		defer elector.Renew(log)()
 
-		select {
-		case <-signalCh:
-			stop()
-		case <-time.After(checkIntervalDuration):
+		// Another replica may have initialized vault between the health check and winning the lease
+		status, err := vault.SealStatus()
+		if err != nil {
+			log.Errorf("Could not read seal status: %s", err)
+			return VaultToken{}, false
+		}
+		if status.Initialized {
+			log.Infof("Vault was initialized by another replica.")
+			return VaultToken{}, false
 		}
 	}
-}
\ No newline at end of file
+
+	// Keys already stored belong to another vault, or to this one before it lost its storage, and must not be replaced
+	exists, err := store.Exists()
+	if err != nil {
+		log.Errorf("Could not check for stored keys: %s", err)
+		return VaultToken{}, false
+	}
+	if exists {
+		log.Warnf("Vault is not initialized but keys are already stored, not initializing it.")
+		return VaultToken{}, false
+	}
+
+	initAttempts.WithLabelValues(server).Inc()
+	vaultResponse, err := vault.Initialize()
+	if err != nil {
+		initFailures.WithLabelValues(server, failureReason(err)).Inc()
+		log.Errorf("Could not initialize vault: %s", err)
+		return VaultToken{}, false
+	}
+
+	log.Infof("Initialized!! Saving Tokens")
+	if err := store.Save(vaultResponse); err != nil {
+		initFailures.WithLabelValues(server, "save_keys").Inc()
+		log.Errorf("Could not save the keys of the newly initialized vault: %s", err)
+		return VaultToken{}, false
+	}
+
+	return vaultResponse, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	vaultStateGauge = newGauge("vault_init_vault_state", "The last observed state of the vault server, 1 for the current state.", "server", "state")
+
+	lastCheckGauge = newGauge("vault_init_last_successful_check_timestamp_seconds", "Unix time of the last successful health check of the vault server.", "server")
+
+	initAttempts = newCounter("vault_init_init_attempts_total", "Attempts to initialize vault.", "server")
+	initFailures = newCounter("vault_init_init_failures_total", "Failed attempts to initialize vault.", "server", "reason")
+
+	unsealAttempts = newCounter("vault_init_unseal_attempts_total", "Attempts to unseal vault.", "server")
+	unsealFailures = newCounter("vault_init_unseal_failures_total", "Failed attempts to unseal vault.", "server", "reason")
+
+	envelopeReads = newCounter("vault_init_envelope_reads_total", "Values read from an encrypted key store, by the key-encryption key that opened them: current, previous or plaintext.", "key")
+
+	vaultRequestDuration      = newHistogram("vault_init_vault_request_duration_seconds", "Latency of requests to the vault API.", "method")
+	kubernetesRequestDuration = newHistogram("vault_init_kubernetes_request_duration_seconds", "Latency of requests to the Kubernetes API.", "method")
+)
+
+// newCounter - registers a counter family with the default registry, served on /metrics
+func newCounter(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	prometheus.MustRegister(c)
+	return c
+}
+
+// newGauge - registers a gauge family with the default registry
+func newGauge(name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	prometheus.MustRegister(g)
+	return g
+}
+
+// newHistogram - registers a histogram family with the default buckets, from 5ms to 10s
+func newHistogram(name, help string, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: prometheus.DefBuckets}, labels)
+	prometheus.MustRegister(h)
+	return h
+}
+
+// failure tags an error with the reason it is counted under
+type failure struct {
+	reason string
+	error
+}
+
+// failureReason - returns the reason label for err
+func failureReason(err error) string {
+	switch e := err.(type) {
+	case failure:
+		return e.reason
+	case *VaultError:
+		return "vault_error"
+	case *url.Error:
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// recordState - records the state of the named server and the time it was checked
+func recordState(server string, state VaultState) {
+	for _, s := range VaultStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		vaultStateGauge.WithLabelValues(server, string(s)).Set(value)
+	}
+
+	lastCheckGauge.WithLabelValues(server).SetToCurrentTime()
+}
+
+// instrumentedTransport observes the latency of every request made through it
+type instrumentedTransport struct {
+	next      http.RoundTripper
+	histogram *prometheus.HistogramVec
+}
+
+// RoundTrip - sends the request with the wrapped transport, observing how long it took
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	start := time.Now()
+	res, err := next.RoundTrip(req)
+	t.histogram.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+
+	return res, err
+}
+
+// listenAddr - returns LISTEN_ADDR, the address /metrics and the probes are served on
+func listenAddr() string {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	return ":8080"
+}
+
+// serveHTTP - serves /metrics, /healthz and /readyz on LISTEN_ADDR in the background
+func serveHTTP(probes *Probes) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", probes.handleHealthz)
+	mux.HandleFunc("/readyz", probes.handleReadyz)
+
+	addr := listenAddr()
+	go func() {
+		logger.Fatalf("Could not serve metrics and probes: %s", http.ListenAndServe(addr, mux))
+	}()
+
+	logger.Infof("Serving metrics and probes on %s", addr)
+}
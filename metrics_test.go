@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetrics(t *testing.T) {
+	recordState("vault-0", StateSealed)
+	unsealFailures.WithLabelValues("vault-0", failureReason(failure{"keys_rejected", errors.New("still sealed")})).Inc()
+	vaultRequestDuration.WithLabelValues("PUT").Observe(0.2)
+
+	histogram := newHistogram("vault_init_test_seconds", "Test histogram.", "path")
+	histogram.WithLabelValues(`say "hi"`).Observe(0.02)
+	histogram.WithLabelValues(`say "hi"`).Observe(20)
+
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, expected := range []string{
+		"# TYPE vault_init_vault_state gauge\n",
+		`vault_init_vault_state{server="vault-0",state="sealed"} 1` + "\n",
+		`vault_init_vault_state{server="vault-0",state="active"} 0` + "\n",
+		`vault_init_unseal_failures_total{reason="keys_rejected",server="vault-0"} 1` + "\n",
+		`vault_init_vault_request_duration_seconds_bucket{method="PUT",le="0.25"} 1` + "\n",
+		`vault_init_vault_request_duration_seconds_bucket{method="PUT",le="0.1"} 0` + "\n",
+		`vault_init_test_seconds_bucket{path="say \"hi\"",le="0.025"} 1` + "\n",
+		`vault_init_test_seconds_bucket{path="say \"hi\"",le="+Inf"} 2` + "\n",
+		`vault_init_test_seconds_count{path="say \"hi\""} 2` + "\n",
+		`vault_init_test_seconds_sum{path="say \"hi\""} 20.02` + "\n",
+		"vault_init_last_successful_check_timestamp_seconds{server=\"vault-0\"} ",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in:\n%s", expected, body)
+		}
+	}
+}
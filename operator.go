@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadOperatorPublicKey - reads a PEM encoded RSA public key that secrets are encrypted to before being printed
+func LoadOperatorPublicKey(path string) (*rsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded public key", path)
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("operator public key must be an RSA key")
+		}
+		return rsaKey, nil
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+}
+
+// EncryptForOperator - encrypts a secret with RSA-OAEP (SHA-256) so only the holder of the private key can read it.
+// Decrypt with: base64 -d | openssl pkeyutl -decrypt -inkey key.pem -pkeyopt rsa_padding_mode:oaep -pkeyopt rsa_oaep_md:sha256
+func EncryptForOperator(key *rsa.PublicKey, secret string) (string, error) {
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, []byte(secret), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
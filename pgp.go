@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// PGPKeys holds the public keys shares are encrypted to at initialization, set by main when PGP is configured
+var PGPKeys *PGPConfig
+
+// errPGPNotForKey is returned when a message is not encrypted to any of the private keys
+var errPGPNotForKey = errors.New("pgp: message is not encrypted to the auto-unseal key")
+
+// PGPConfig holds the custodian public keys Vault encrypts the unseal keys and root token to
+type PGPConfig struct {
+	// Custodians names the holder of each share, in share order
+	Custodians []string
+
+	// Keys holds the base64 encoded binary public key of each share, in share order
+	Keys []string
+
+	// RootTokenKey is the base64 encoded binary public key the root token is encrypted to
+	RootTokenKey string
+
+	// AutoUnsealShares is the number of shares encrypted to the auto-unseal key
+	AutoUnsealShares int
+
+	// autoUnseal holds the private keys vault-init decrypts its own shares with
+	autoUnseal openpgp.EntityList
+}
+
+// NewPGPConfig - loads the custodian keys from PGP_KEYS_DIR, PGP_ROOT_TOKEN_KEY_FILE and PGP_AUTO_UNSEAL_*, returning nil if PGP is not configured
+func NewPGPConfig() (*PGPConfig, error) {
+	keysDir := os.Getenv("PGP_KEYS_DIR")
+	rootTokenKeyFile := os.Getenv("PGP_ROOT_TOKEN_KEY_FILE")
+	autoUnsealPublic := os.Getenv("PGP_AUTO_UNSEAL_PUBLIC_KEY_FILE")
+	autoUnsealPrivate := os.Getenv("PGP_AUTO_UNSEAL_PRIVATE_KEY_FILE")
+
+	if keysDir == "" && rootTokenKeyFile == "" && autoUnsealPublic == "" {
+		return nil, nil
+	}
+
+	c := &PGPConfig{}
+
+	if keysDir != "" {
+		files, err := ioutil.ReadDir(keysDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read PGP_KEYS_DIR: %s", err)
+		}
+
+		var names []string
+		for _, f := range files {
+			// ConfigMap volumes hold ..data style entries next to the keys
+			if !strings.HasPrefix(f.Name(), ".") {
+				names = append(names, f.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			key, err := readPGPPublicKey(filepath.Join(keysDir, name))
+			if err != nil {
+				return nil, err
+			}
+			c.Custodians = append(c.Custodians, name)
+			c.Keys = append(c.Keys, key)
+		}
+	}
+
+	if autoUnsealPublic != "" {
+		if autoUnsealPrivate == "" {
+			return nil, errors.New("PGP_AUTO_UNSEAL_PRIVATE_KEY_FILE must be set with PGP_AUTO_UNSEAL_PUBLIC_KEY_FILE")
+		}
+
+		key, err := readPGPPublicKey(autoUnsealPublic)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadFile(autoUnsealPrivate)
+		if err != nil {
+			return nil, err
+		}
+
+		c.autoUnseal, err = readPGPPrivateKeys(b)
+		if err != nil {
+			return nil, fmt.Errorf("PGP_AUTO_UNSEAL_PRIVATE_KEY_FILE is invalid: %s", err)
+		}
+
+		// vault-init holds enough shares to unseal on its own unless told otherwise
+		shares := TokensRequired
+		if v := os.Getenv("PGP_AUTO_UNSEAL_SHARES"); v != "" {
+			shares, err = strconv.Atoi(v)
+			if err != nil || shares < 1 {
+				return nil, fmt.Errorf("PGP_AUTO_UNSEAL_SHARES is invalid: %q", v)
+			}
+		}
+
+		c.AutoUnsealShares = shares
+		for i := 0; i < shares; i++ {
+			c.Custodians = append(c.Custodians, "vault-init")
+			c.Keys = append(c.Keys, key)
+		}
+	}
+
+	if rootTokenKeyFile != "" {
+		key, err := readPGPPublicKey(rootTokenKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootTokenKey = key
+	}
+
+	return c, nil
+}
+
+// DecryptShares - decrypts the shares encrypted to the auto-unseal key, naming the failing share as prefix followed by its number
+func (c *PGPConfig) DecryptShares(prefix string, keys []string) ([]string, error) {
+	var decrypted []string
+
+	if len(c.autoUnseal) == 0 {
+		return nil, nil
+	}
+
+	for i, key := range keys {
+		k, err := c.Decrypt(key)
+		if err == errPGPNotForKey {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s%d: %s", prefix, i+1, err)
+		}
+		registerSecrets(k)
+		decrypted = append(decrypted, k)
+	}
+
+	return decrypted, nil
+}
+
+// Decrypt - decrypts a share or root token returned by Vault, hex or base64 encoded
+func (c *PGPConfig) Decrypt(encoded string) (string, error) {
+	message, err := hex.DecodeString(encoded)
+	if err != nil {
+		message, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", errors.New("pgp: message is neither hex nor base64 encoded")
+		}
+	}
+
+	plaintext, err := decryptPGPMessage(message, c.autoUnseal)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// PGPKeyStore stores the PGP encrypted shares as returned by Vault and decrypts the auto-unseal shares when loading
+type PGPKeyStore struct {
+	KeyStore
+	config *PGPConfig
+}
+
+// NewPGPKeyStore - wraps store to decrypt the shares encrypted to the auto-unseal key
+func NewPGPKeyStore(store KeyStore, config *PGPConfig) *PGPKeyStore {
+	return &PGPKeyStore{
+		KeyStore: store,
+		config:   config,
+	}
+}
+
+// Save - stores the encrypted shares for distribution, logging which custodian can decrypt each one
+func (s *PGPKeyStore) Save(tokens VaultToken) error {
+	s.logCustodians(tokens)
+	return s.KeyStore.Save(tokens)
+}
+
+// Rotate - replaces the stored shares with the encrypted shares of a rekey, keeping a backup under version
+func (s *PGPKeyStore) Rotate(tokens VaultToken, version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+
+	s.logCustodians(tokens)
+	return rotator.Rotate(tokens, version)
+}
+
+// Restore - puts the shares backed up under version back in place
+func (s *PGPKeyStore) Restore(version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+	return rotator.Restore(version)
+}
+
+// DeleteBackup - removes the shares backed up under version
+func (s *PGPKeyStore) DeleteBackup(version string) error {
+	rotator, err := keyRotator(s.KeyStore)
+	if err != nil {
+		return err
+	}
+	return rotator.DeleteBackup(version)
+}
+
+// SaveRootToken - stores token in place of the current root token
+func (s *PGPKeyStore) SaveRootToken(token string) error {
+	rootStore, err := rootTokenStore(s.KeyStore)
+	if err != nil {
+		return err
+	}
+	return rootStore.SaveRootToken(token)
+}
+
+// LoadRootToken - returns the stored root token, which is PGP encrypted if it was stored by Initialize with PGP_ROOT_TOKEN_KEY_FILE set
+func (s *PGPKeyStore) LoadRootToken() (string, error) {
+	rootStore, err := rootTokenStore(s.KeyStore)
+	if err != nil {
+		return "", err
+	}
+	return rootStore.LoadRootToken()
+}
+
+// Load - returns the shares vault-init can decrypt, skipping those encrypted to other custodians
+func (s *PGPKeyStore) Load() (VaultToken, error) {
+	encrypted, err := s.KeyStore.Load()
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	// Retired keys can not unseal vault, so they are left encrypted for their custodians
+	tokens := VaultToken{RootToken: encrypted.RootToken, RetiredKeys: encrypted.RetiredKeys}
+
+	if tokens.Tokens, err = s.config.DecryptShares("key", encrypted.Tokens); err != nil {
+		return VaultToken{}, err
+	}
+
+	// Recovery keys are only needed to migrate off an auto-unseal seal
+	if tokens.RecoveryKeys, err = s.config.DecryptShares("recovery-key", encrypted.RecoveryKeys); err != nil {
+		return VaultToken{}, err
+	}
+
+	return tokens, nil
+}
+
+// logCustodians - logs which custodian can decrypt each share
+func (s *PGPKeyStore) logCustodians(tokens VaultToken) {
+	for i := range tokens.Tokens {
+		if i < len(s.config.Custodians) {
+			logger.Infof("key%d is encrypted to %s", i+1, s.config.Custodians[i])
+		}
+	}
+
+	for i := range tokens.RecoveryKeys {
+		if i < len(s.config.Custodians) {
+			logger.Infof("recovery-key%d is encrypted to %s", i+1, s.config.Custodians[i])
+		}
+	}
+}
+
+// readPGPPublicKey - reads an armored or binary public key and returns it base64 encoded, as Vault expects
+func readPGPPublicKey(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := dearmorPGP(b)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", path, err)
+	}
+
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+	if err != nil || len(entities) == 0 {
+		return "", fmt.Errorf("%s does not contain a PGP public key", path)
+	}
+
+	// Vault would hand the whole key to every caller of sys/init
+	if entities[0].PrivateKey != nil {
+		return "", fmt.Errorf("%s contains a PGP private key", path)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// dearmorPGP - decodes ASCII armored PGP data, passing binary data through unchanged
+func dearmorPGP(b []byte) ([]byte, error) {
+	if !bytes.Contains(b, []byte("-----BEGIN PGP")) {
+		return b, nil
+	}
+
+	block, err := armor.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(block.Body)
+}
+
+// readPGPPrivateKeys - reads the private keys and subkeys from an armored or binary key, none of which may be passphrase protected
+func readPGPPrivateKeys(b []byte) (openpgp.EntityList, error) {
+	key, err := dearmorPGP(b)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, errors.New("pgp: no private key found")
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			return nil, errors.New("pgp: private key must not be passphrase protected")
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				return nil, errors.New("pgp: private key must not be passphrase protected")
+			}
+		}
+	}
+
+	return entities, nil
+}
+
+// decryptPGPMessage - decrypts a public key encrypted, integrity protected OpenPGP message and returns its literal data
+func decryptPGPMessage(message []byte, keys openpgp.EntityList) ([]byte, error) {
+	if err := checkPGPIntegrity(message); err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(message), keys, nil, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		return nil, errPGPNotForKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !md.IsEncrypted {
+		return nil, errors.New("pgp: message is not encrypted")
+	}
+
+	// The integrity check runs once the literal data is read to the end
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+// checkPGPIntegrity - refuses a message whose encrypted data has no modification detection code, which openpgp would decrypt anyway
+func checkPGPIntegrity(message []byte) error {
+	packets := packet.NewReader(bytes.NewReader(message))
+
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch p := p.(type) {
+		case *packet.EncryptedKey, *packet.SymmetricKeyEncrypted:
+			continue
+		case *packet.SymmetricallyEncrypted:
+			if !p.MDC {
+				return errors.New("pgp: messages without integrity protection are not supported")
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Probes reports on /healthz whether the control loop makes progress, and on /readyz whether its dependencies are reachable
+type Probes struct {
+	// Interval is the time between checks, MaxMissed how many intervals may pass without a check completing
+	Interval  time.Duration
+	MaxMissed int
+
+	checks []readinessCheck
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// readinessCheck is a named dependency checked by /readyz
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// NewProbes - creates probes for a loop checking every interval, reading PROBE_MISSED_INTERVALS
+func NewProbes(interval time.Duration) (*Probes, error) {
+	p := &Probes{Interval: interval, MaxMissed: 3, last: time.Now()}
+
+	if v := os.Getenv("PROBE_MISSED_INTERVALS"); v != "" {
+		missed, err := strconv.Atoi(v)
+		if err != nil || missed < 1 {
+			return nil, fmt.Errorf("PROBE_MISSED_INTERVALS is invalid: %q", v)
+		}
+		p.MaxMissed = missed
+	}
+
+	return p, nil
+}
+
+// AddCheck - adds a dependency /readyz checks
+func (p *Probes) AddCheck(name string, check func() error) {
+	p.checks = append(p.checks, readinessCheck{name: name, check: check})
+}
+
+// Progress - records that the control loop completed a check
+func (p *Probes) Progress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = time.Now()
+}
+
+// Live - returns an error if no check completed within the allowed intervals
+func (p *Probes) Live() error {
+	p.mu.Lock()
+	last := p.last
+	p.mu.Unlock()
+
+	// A check may be waiting on a vault request, so its timeout is allowed on top
+	deadline := time.Duration(p.MaxMissed)*p.Interval + httpClient.Timeout
+	if since := time.Since(last); since > deadline {
+		return fmt.Errorf("no check completed for %s", since.Round(time.Second))
+	}
+
+	return nil
+}
+
+// Ready - returns an error if the loop is stuck or a dependency is unreachable
+func (p *Probes) Ready() error {
+	if err := p.Live(); err != nil {
+		return err
+	}
+
+	for _, c := range p.checks {
+		if err := c.check(); err != nil {
+			return fmt.Errorf("%s: %s", c.name, err)
+		}
+	}
+
+	return nil
+}
+
+// handleHealthz - answers 200 while the control loop makes progress, 503 otherwise
+func (p *Probes) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, p.Live())
+}
+
+// handleReadyz - answers 200 while the control loop makes progress and its dependencies are reachable, 503 otherwise
+func (p *Probes) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, p.Ready())
+}
+
+// writeProbe - writes ok, or the error with a 503
+func writeProbe(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbes(t *testing.T) {
+	probes, err := NewProbes(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vaultErr := errors.New("connection refused")
+	probes.AddCheck("vault", func() error { return vaultErr })
+
+	probe := func(handler func(*httptest.ResponseRecorder)) int {
+		recorder := httptest.NewRecorder()
+		handler(recorder)
+		return recorder.Code
+	}
+	healthz := func(w *httptest.ResponseRecorder) {
+		probes.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	}
+	readyz := func(w *httptest.ResponseRecorder) { probes.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil)) }
+
+	if code := probe(healthz); code != 200 {
+		t.Fatalf("expected a fresh loop to be live, got %d", code)
+	}
+	if code := probe(readyz); code != 503 {
+		t.Fatalf("expected not ready while vault is unreachable, got %d", code)
+	}
+
+	vaultErr = nil
+	if code := probe(readyz); code != 200 {
+		t.Fatalf("expected ready once vault is reachable, got %d", code)
+	}
+
+	// No check completed for longer than three intervals and the request timeout
+	probes.last = time.Now().Add(-3*probes.Interval - httpClient.Timeout - time.Second)
+	if code := probe(healthz); code != 503 {
+		t.Fatalf("expected a stuck loop not to be live, got %d", code)
+	}
+	if code := probe(readyz); code != 503 {
+		t.Fatalf("expected a stuck loop not to be ready, got %d", code)
+	}
+
+	probes.Progress()
+	if code := probe(healthz); code != 200 {
+		t.Fatalf("expected the loop to be live after a check completed, got %d", code)
+	}
+}
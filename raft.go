@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RaftJoiner joins uninitialized vault servers using integrated storage to the active node of their cluster
+type RaftJoiner struct {
+	// LeaderAddrs are the API addresses of the servers that may be the active node
+	LeaderAddrs []string
+
+	// ServiceName is a headless service whose endpoints are used when LeaderAddrs is empty
+	ServiceName string
+	Namespace   string
+	Scheme      string
+	Port        string
+
+	// LeaderCACert and LeaderTLSServerName are passed to vault to verify the active node
+	LeaderCACert        string
+	LeaderTLSServerName string
+}
+
+// NewRaftJoiner - creates a joiner from RAFT_LEADER_API_ADDRS or RAFT_SERVICE_NAME, returning nil if neither is set
+func NewRaftJoiner() (*RaftJoiner, error) {
+	r := &RaftJoiner{
+		ServiceName:         os.Getenv("RAFT_SERVICE_NAME"),
+		Namespace:           os.Getenv("VAULT_NAMESPACE"),
+		Scheme:              os.Getenv("VAULT_POD_SCHEME"),
+		Port:                os.Getenv("VAULT_POD_PORT"),
+		LeaderTLSServerName: os.Getenv("RAFT_LEADER_TLS_SERVER_NAME"),
+	}
+
+	for _, addr := range strings.Split(os.Getenv("RAFT_LEADER_API_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			r.LeaderAddrs = append(r.LeaderAddrs, strings.TrimRight(addr, "/"))
+		}
+	}
+
+	if len(r.LeaderAddrs) == 0 && r.ServiceName == "" {
+		return nil, nil
+	}
+
+	if r.Namespace == "" {
+		r.Namespace = kubeClient.Namespace
+	}
+
+	if r.Scheme == "" {
+		r.Scheme = "http"
+	}
+
+	if r.Port == "" {
+		r.Port = "8200"
+	}
+
+	if path := os.Getenv("RAFT_LEADER_CA_CERT_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("RAFT_LEADER_CA_CERT_FILE is invalid: %s", err)
+		}
+		r.LeaderCACert = string(b)
+	}
+
+	return r, nil
+}
+
+// Leaders - returns the configured leader addresses, or those of the pods behind the headless service other than this one
+func (r *RaftJoiner) Leaders() ([]string, error) {
+	if len(r.LeaderAddrs) > 0 {
+		return r.LeaderAddrs, nil
+	}
+
+	res, err := kubernetesRequest("GET", "/api/v1/namespaces/"+r.Namespace+"/endpoints/"+r.ServiceName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("get endpoints %s: non 200 status code: %d", r.ServiceName, res.StatusCode)
+	}
+
+	endpoints := Endpoints{}
+	if err := json.Unmarshal(body, &endpoints); err != nil {
+		return nil, fmt.Errorf("get endpoints %s: %s", r.ServiceName, err)
+	}
+
+	var addrs []string
+	for _, subset := range endpoints.Subsets {
+		// Sealed pods are usually not ready, but their peers still need to find them
+		for _, address := range append(subset.Addresses, subset.NotReadyAddresses...) {
+			if address.IP == os.Getenv("POD_IP") || (address.Hostname != "" && address.Hostname == os.Getenv("POD_NAME")) {
+				continue
+			}
+
+			// The stable DNS name of a StatefulSet pod is what its certificate is usually issued for
+			host := address.IP
+			if address.Hostname != "" {
+				host = address.Hostname + "." + r.ServiceName + "." + r.Namespace + ".svc"
+			}
+			addrs = append(addrs, r.Scheme+"://"+host+":"+r.Port)
+		}
+	}
+
+	return addrs, nil
+}
+
+// Join - joins vault to the active node among the leaders, reporting false when no cluster exists yet and vault may be initialized instead
+func (r *RaftJoiner) Join(vault *VaultClient, store KeyStore) (bool, error) {
+	leaders, err := r.Leaders()
+	if err != nil {
+		return false, fmt.Errorf("could not find the raft leaders: %s", err)
+	}
+
+	initialized := 0
+
+	for _, addr := range leaders {
+		if addr == vault.Addr {
+			continue
+		}
+
+		status, err := (&VaultClient{Addr: addr}).Status()
+		if err != nil {
+			logger.Warnf("Could not reach raft leader %s: %s", addr, err)
+			continue
+		}
+
+		switch status.State() {
+		case StateActive:
+			request := RaftJoinRequest{
+				LeaderAPIAddr:       addr,
+				LeaderCACert:        r.LeaderCACert,
+				LeaderTLSServerName: r.LeaderTLSServerName,
+			}
+
+			response := RaftJoinResponse{}
+			if err := vault.request("POST", "/v1/sys/storage/raft/join", request, &response); err != nil {
+				return false, fmt.Errorf("could not join %s: %s", addr, err)
+			}
+			if !response.Joined {
+				return false, fmt.Errorf("vault did not join %s", addr)
+			}
+
+			logger.Infof("Joined the raft cluster of %s", addr)
+			return true, nil
+		case StateUninitialized:
+			// Not initialized, so not a member of a cluster either
+		default:
+			initialized++
+		}
+	}
+
+	if initialized > 0 {
+		return false, fmt.Errorf("%d raft leaders are initialized but none is active yet", initialized)
+	}
+
+	// The peers may be restarting, in which case initializing would create a second cluster
+	exists, err := store.Exists()
+	if err != nil {
+		return false, fmt.Errorf("could not check for stored keys: %s", err)
+	}
+	if exists {
+		return false, errors.New("keys are stored but no raft leader is active, waiting for the cluster rather than initializing a new one")
+	}
+
+	return false, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRaftJoin(t *testing.T) {
+	_, server := newFakeKubernetes()
+	defer server.Close()
+
+	leaderHealth := HealthResponse{}
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sys/seal-status" {
+			json.NewEncoder(w).Encode(SealStatusResponse{Initialized: leaderHealth.Initialized, Sealed: leaderHealth.Sealed})
+			return
+		}
+		json.NewEncoder(w).Encode(leaderHealth)
+	}))
+	defer leader.Close()
+
+	var joinRequest RaftJoinRequest
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sys/storage/raft/join" {
+			json.NewDecoder(r.Body).Decode(&joinRequest)
+			w.Write([]byte(`{"joined":true}`))
+		}
+	}))
+	defer follower.Close()
+
+	raft := &RaftJoiner{LeaderAddrs: []string{leader.URL}, LeaderTLSServerName: "vault"}
+	vault := &VaultClient{Addr: follower.URL}
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+
+	// Nobody is initialized and nothing is stored, so the caller may initialize
+	if joined, err := raft.Join(vault, store); joined || err != nil {
+		t.Fatalf("expected vault to be left to initialize, got %v, %v", joined, err)
+	}
+
+	if err := store.Save(VaultToken{Tokens: []string{"k1", "k2", "k3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raft.Join(vault, store); err == nil {
+		t.Fatal("expected an error rather than a second cluster when keys are stored")
+	}
+
+	leaderHealth = HealthResponse{Initialized: true, Sealed: true}
+	if _, err := raft.Join(vault, store); err == nil || !strings.Contains(err.Error(), "none is active") {
+		t.Fatalf("expected to wait for a sealed leader, got %v", err)
+	}
+
+	leaderHealth = HealthResponse{Initialized: true}
+	joined, err := raft.Join(vault, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !joined || joinRequest.LeaderAPIAddr != leader.URL || joinRequest.LeaderTLSServerName != "vault" {
+		t.Fatalf("expected vault to join %s, got %v, %+v", leader.URL, joined, joinRequest)
+	}
+}
+
+func TestRaftLeadersFromService(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	fake.objects["/api/v1/namespaces/vault/endpoints/vault-internal"] = map[string]interface{}{
+		"subsets": []interface{}{
+			map[string]interface{}{
+				"addresses": []interface{}{
+					map[string]interface{}{"ip": "10.0.0.1", "hostname": "vault-0"},
+				},
+				"notReadyAddresses": []interface{}{
+					map[string]interface{}{"ip": "10.0.0.2", "hostname": "vault-1"},
+					map[string]interface{}{"ip": "10.0.0.3"},
+				},
+			},
+		},
+	}
+
+	os.Setenv("RAFT_SERVICE_NAME", "vault-internal")
+	os.Setenv("VAULT_POD_SCHEME", "https")
+	os.Setenv("POD_NAME", "vault-1")
+	defer os.Unsetenv("RAFT_SERVICE_NAME")
+	defer os.Unsetenv("VAULT_POD_SCHEME")
+	defer os.Unsetenv("POD_NAME")
+
+	raft, err := NewRaftJoiner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaders, err := raft.Leaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "https://vault-0.vault-internal.vault.svc:8200,https://10.0.0.3:8200"
+	if strings.Join(leaders, ",") != expected {
+		t.Fatalf("expected %s without this pod, got %v", expected, leaders)
+	}
+}
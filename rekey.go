@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Rekey - replaces the unseal keys, or the recovery keys of an auto-unseal vault, using the stored keys.
+// The new keys are stored with the old ones kept as a backup until vault confirms the new keys are in use.
+func (v *VaultClient) Rekey(store KeyStore) error {
+	rotator, err := keyRotator(store)
+	if err != nil {
+		return fmt.Errorf("rekey: %s", err)
+	}
+
+	status, err := v.SealStatus()
+	if err != nil {
+		return err
+	}
+	if status.Sealed {
+		return errors.New("rekey: vault must be unsealed")
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("rekey: could not load keys: %s", err)
+	}
+
+	// Only the rekeyed set is replaced, the PGP encrypted shares of the others are kept as they are stored
+	rotated := tokens
+	if pgpStore, ok := store.(*PGPKeyStore); ok {
+		if rotated, err = pgpStore.KeyStore.Load(); err != nil {
+			return fmt.Errorf("rekey: could not load keys: %s", err)
+		}
+	}
+
+	path := "/v1/sys/rekey"
+	keys := tokens.Tokens
+	if status.AutoUnseal() {
+		path = "/v1/sys/rekey-recovery-key"
+		keys = tokens.RecoveryKeys
+	}
+
+	request := rekeyRequest(status)
+
+	// A rekey left over from a crashed run was started with settings and keys vault-init no longer knows about
+	current := RekeyResponse{}
+	if err := v.request("GET", path+"/init", nil, &current); err != nil {
+		return err
+	}
+	if current.Started {
+		logger.Infof("Cancelling the rekey left by an earlier attempt")
+		if err := v.request("DELETE", path+"/init", nil, nil); err != nil {
+			return err
+		}
+	}
+
+	rekey := RekeyResponse{}
+	if err := v.request("PUT", path+"/init", request, &rekey); err != nil {
+		return fmt.Errorf("rekey: could not start: %s", err)
+	}
+
+	// Vault before 0.10.2 ignores require_verification and puts the new keys in use as soon as they are generated,
+	// so plaintext keys that then could not be stored would be lost
+	if request.RequireVerification && !rekey.VerificationRequired && len(request.PGPKeys) == 0 {
+		v.cancelRekey(path)
+		return errors.New("rekey: vault does not support verifying the new keys, which is required unless they are PGP encrypted")
+	}
+
+	logger.Infof("Rekeying to %d shares with a threshold of %d, %d of the %d stored keys are required", request.SecretShares, request.SecretThreshold, rekey.Required, len(keys))
+
+	result := RekeyResponse{}
+	if err := v.submitShares(path+"/update", rekey.Nonce, keys, &result); err != nil {
+		v.cancelRekey(path)
+		return fmt.Errorf("rekey: %s", err)
+	}
+
+	// PGP encrypted keys are safe to log, the plaintext ones never are
+	if len(request.PGPKeys) == 0 {
+		registerSecrets(result.Keys...)
+	}
+
+	rotated.VaultVersion = status.Version
+	rotated.Threshold = request.SecretThreshold
+	if status.AutoUnseal() {
+		rotated.RecoveryKeys = result.Keys
+	} else {
+		rotated.Tokens = result.Keys
+	}
+
+	version := time.Now().UTC().Format("20060102-150405")
+
+	if err := rotator.Rotate(rotated, version); err != nil {
+		if result.VerificationRequired {
+			// The old keys stay in use until the new ones are verified
+			v.cancelRekey(path)
+			return fmt.Errorf("rekey: could not store the new keys, the old keys are still in use: %s", err)
+		}
+
+		// Without verification the new keys are already in use, and they are PGP encrypted so they can be logged
+		for i, key := range result.Keys {
+			logger.With(Fields{"encrypted_key": key}).Errorf("New key%d", i+1)
+		}
+		return fmt.Errorf("rekey: could not store the new keys, they are logged above: %s", err)
+	}
+
+	if result.VerificationRequired {
+		if err := v.verifyRekey(path, result); err != nil {
+			v.cancelRekey(path)
+			if restoreErr := rotator.Restore(version); restoreErr != nil {
+				return fmt.Errorf("rekey: %s, and the old keys could not be restored from backup %s: %s", err, version, restoreErr)
+			}
+			return fmt.Errorf("rekey: %s, the old keys were restored", err)
+		}
+	}
+
+	status, err = v.SealStatus()
+	if err != nil {
+		return fmt.Errorf("rekey: could not confirm the new keys, the old keys are kept in backup %s: %s", version, err)
+	}
+	if status.N != request.SecretShares || status.T != request.SecretThreshold {
+		return fmt.Errorf("rekey: vault reports %d shares with a threshold of %d, the old keys are kept in backup %s", status.N, status.T, version)
+	}
+
+	if err := rotator.DeleteBackup(version); err != nil {
+		logger.Warnf("Could not delete backup %s of the old keys: %s", version, err)
+	}
+
+	logger.Infof("Rekey complete, %d new keys are stored", len(result.Keys))
+	return nil
+}
+
+// rekeyRequest - builds the rekey parameters, keeping the current shares and threshold unless SECRET_SHARES, SECRET_THRESHOLD or PGP keys change them
+func rekeyRequest(status SealStatusResponse) RekeyRequest {
+	request := RekeyRequest{
+		SecretShares:    status.N,
+		SecretThreshold: status.T,
+	}
+
+	if os.Getenv("SECRET_SHARES") != "" || (PGPKeys != nil && len(PGPKeys.Keys) > 0) {
+		request.SecretShares = NumTokens
+	}
+
+	if os.Getenv("SECRET_THRESHOLD") != "" {
+		request.SecretThreshold = TokensRequired
+	}
+
+	// vault-init can only verify the new keys when it can read enough of them
+	request.RequireVerification = true
+	if PGPKeys != nil && len(PGPKeys.Keys) > 0 {
+		request.PGPKeys = PGPKeys.Keys
+		request.RequireVerification = PGPKeys.AutoUnsealShares >= request.SecretThreshold
+	}
+
+	return request
+}
+
+// verifyRekey - submits the new keys to the verify path, which puts them in use
+func (v *VaultClient) verifyRekey(path string, result RekeyResponse) error {
+	keys := result.Keys
+
+	if PGPKeys != nil && len(PGPKeys.Keys) > 0 {
+		var err error
+		keys, err = PGPKeys.DecryptShares("key", keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	verified := ShareProgress{}
+	if err := v.submitShares(path+"/verify", result.VerificationNonce, keys, &verified); err != nil {
+		return fmt.Errorf("could not verify the new keys: %s", err)
+	}
+
+	return nil
+}
+
+// cancelRekey - cancels the rekey in progress, leaving the old keys in use
+func (v *VaultClient) cancelRekey(path string) {
+	if err := v.request("DELETE", path+"/init", nil, nil); err != nil {
+		logger.Warnf("Could not cancel the rekey: %s", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeRekeyVault serves the seal-status and rekey endpoints of an unsealed vault with keys k1..kN
+type fakeRekeyVault struct {
+	t, n       int
+	request    RekeyRequest
+	started    bool
+	progress   int
+	newKeys    []string
+	cancelled  bool
+	rejectKeys bool
+
+	// ignoreVerification acts like vault before 0.10.2, which puts the new keys in use without verifying them
+	ignoreVerification bool
+}
+
+// verificationRequired - reports whether the new keys wait for verification before they are put in use
+func (f *fakeRekeyVault) verificationRequired() bool {
+	return f.request.RequireVerification && !f.ignoreVerification
+}
+
+func (f *fakeRekeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var share ShareRequest
+
+	switch r.URL.Path {
+	case "/v1/sys/seal-status":
+		json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Initialized: true, T: f.t, N: f.n})
+
+	case "/v1/sys/rekey/init":
+		switch r.Method {
+		case "PUT":
+			json.NewDecoder(r.Body).Decode(&f.request)
+			f.started, f.progress = true, 0
+		case "DELETE":
+			f.started, f.cancelled = false, true
+		}
+		json.NewEncoder(w).Encode(RekeyResponse{ShareProgress: ShareProgress{Nonce: "rekey", Started: f.started, Required: f.t}, VerificationRequired: f.started && f.verificationRequired()})
+
+	case "/v1/sys/rekey/update":
+		json.NewDecoder(r.Body).Decode(&share)
+		if !strings.HasPrefix(share.Key, "k") || share.Nonce != "rekey" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errors":["invalid key"]}`))
+			return
+		}
+
+		f.progress++
+		if f.progress < f.t {
+			json.NewEncoder(w).Encode(RekeyResponse{ShareProgress: ShareProgress{Nonce: "rekey", Progress: f.progress, Required: f.t}})
+			return
+		}
+
+		f.newKeys = nil
+		for i := 1; i <= f.request.SecretShares; i++ {
+			f.newKeys = append(f.newKeys, "new"+strconv.Itoa(i))
+		}
+		f.progress = 0
+		if !f.verificationRequired() {
+			f.t, f.n, f.started = f.request.SecretThreshold, f.request.SecretShares, false
+		}
+		json.NewEncoder(w).Encode(RekeyResponse{
+			ShareProgress:        ShareProgress{Complete: true},
+			Keys:                 f.newKeys,
+			VerificationRequired: f.verificationRequired(),
+			VerificationNonce:    "verify",
+		})
+
+	case "/v1/sys/rekey/verify":
+		json.NewDecoder(r.Body).Decode(&share)
+		if f.rejectKeys || !strings.HasPrefix(share.Key, "new") || share.Nonce != "verify" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errors":["invalid key"]}`))
+			return
+		}
+
+		f.progress++
+		if f.progress < f.request.SecretThreshold {
+			json.NewEncoder(w).Encode(ShareProgress{Nonce: "verify", Progress: f.progress})
+			return
+		}
+
+		f.t, f.n, f.started = f.request.SecretThreshold, f.request.SecretShares, false
+		json.NewEncoder(w).Encode(ShareProgress{Nonce: "verify", Complete: true})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault := &fakeRekeyVault{t: 2, n: 3}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	os.Setenv("VAULT_ADDR", vaultServer.URL)
+	os.Setenv("SECRET_SHARES", "4")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("SECRET_SHARES")
+	defer func(shares int) { NumTokens = shares }(NumTokens)
+	NumTokens = 4
+
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+	if err := store.Save(VaultToken{Tokens: []string{"bad", "k2", "k3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewVaultClient()
+
+	vault.rejectKeys = true
+	if err := client.Rekey(store); err == nil {
+		t.Fatal("expected the rekey to fail when the new keys can not be verified")
+	}
+	if !vault.cancelled {
+		t.Fatal("expected the rekey to be cancelled")
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tokens.Tokens, ",") != "bad,k2,k3" {
+		t.Fatalf("expected the old keys to be restored, got %v", tokens.Tokens)
+	}
+	if backups := fake.list("/api/v1/namespaces/vault/secrets/" + vaultSecretName + "-"); len(backups) != 0 {
+		t.Fatalf("expected the backup to be removed once restored, got %v", backups)
+	}
+
+	vault.rejectKeys = false
+	if err := client.Rekey(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if !vault.request.RequireVerification || vault.request.SecretShares != 4 || vault.request.SecretThreshold != 2 {
+		t.Fatalf("expected a verified rekey to 4 shares keeping the threshold, got %+v", vault.request)
+	}
+
+	tokens, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tokens.Tokens, ",") != "new1,new2,new3,new4" {
+		t.Fatalf("expected the new keys to be stored, got %v", tokens.Tokens)
+	}
+	if backups := fake.list("/api/v1/namespaces/vault/secrets/" + vaultSecretName + "-"); len(backups) != 0 {
+		t.Fatalf("expected the backup to be removed once verified, got %v", backups)
+	}
+}
+
+func TestRekeyKeepsOtherKeys(t *testing.T) {
+	_, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault := &fakeRekeyVault{t: 2, n: 3}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	// A vault migrated from an auto-unseal seal keeps its recovery keys as retired keys
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+	stored := VaultToken{
+		RootToken:    "s.root",
+		Tokens:       []string{"k1", "k2", "k3"},
+		RecoveryKeys: []string{"r1", "r2", "r3"},
+		RetiredKeys:  []string{"k1", "k2", "k3"},
+	}
+	if err := store.Save(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&VaultClient{Addr: vaultServer.URL}).Rekey(store); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tokens.Tokens, ",") != "new1,new2,new3" {
+		t.Fatalf("expected the new keys to be stored, got %v", tokens.Tokens)
+	}
+	if strings.Join(tokens.RecoveryKeys, ",") != "r1,r2,r3" || strings.Join(tokens.RetiredKeys, ",") != "k1,k2,k3" {
+		t.Fatalf("expected the recovery and retired keys to be kept, got %+v", tokens)
+	}
+	if rootToken, err := store.LoadRootToken(); err != nil || rootToken != "s.root" {
+		t.Fatalf("expected the root token to be kept, got %q %v", rootToken, err)
+	}
+}
+
+// failingRotator is a key store that can not store rekeyed keys
+type failingRotator struct {
+	memoryKeyStore
+}
+
+func (s *failingRotator) Rotate(tokens VaultToken, version string) error {
+	return errors.New("rotate failed")
+}
+
+func (s *failingRotator) Restore(version string) error {
+	return nil
+}
+
+func (s *failingRotator) DeleteBackup(version string) error {
+	return nil
+}
+
+func TestRekeyWithoutVerification(t *testing.T) {
+	vault := &fakeRekeyVault{t: 2, n: 3, ignoreVerification: true}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	store := &KubernetesKeyStore{rootTokenSecret: rootTokenSecretName}
+	_, server := newFakeKubernetes()
+	defer server.Close()
+	if err := store.Save(VaultToken{Tokens: []string{"k1", "k2", "k3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext keys must never be generated without verification, they would be lost if they could not be stored
+	client := &VaultClient{Addr: vaultServer.URL}
+	if err := client.Rekey(store); err == nil || !strings.Contains(err.Error(), "verifying") {
+		t.Fatalf("expected the rekey to be refused, got %v", err)
+	}
+	if !vault.cancelled || vault.newKeys != nil {
+		t.Fatalf("expected the rekey to be cancelled before new keys were generated, got %+v", vault)
+	}
+
+	// PGP encrypted keys that could not be stored are logged for their custodians instead
+	defer func(config *PGPConfig) { PGPKeys = config }(PGPKeys)
+	PGPKeys = &PGPConfig{Keys: []string{"pgp1", "pgp2", "pgp3"}, AutoUnsealShares: 0}
+	defer func(shares int) { NumTokens = shares }(NumTokens)
+	NumTokens = 3
+
+	defer func(previous *Logger) { logger = previous }(logger)
+	var out bytes.Buffer
+	if err := setLogger(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &failingRotator{}
+	failing.Save(VaultToken{Tokens: []string{"k1", "k2", "k3"}})
+	if err := client.Rekey(failing); err == nil || !strings.Contains(err.Error(), "logged above") {
+		t.Fatalf("expected the new keys to be logged when they could not be stored, got %v", err)
+	}
+	for _, key := range vault.newKeys {
+		if !strings.Contains(out.String(), key) {
+			t.Fatalf("expected %s to be logged, got %s", key, out.String())
+		}
+	}
+}
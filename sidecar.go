@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Sidecar checks the Vault server running in the same pod as vault-init
+type Sidecar struct {
+	// Name is the pod name, from POD_NAME or the hostname, used in events and metrics
+	Name string
+
+	vault *VaultClient
+
+	vaultChecker
+}
+
+// NewSidecar - creates a sidecar for the Vault server at VAULT_ADDR
+func NewSidecar(store KeyStore, elector *LeaderElector, bootstrapper *Bootstrapper, raft *RaftJoiner) (*Sidecar, error) {
+	s := &Sidecar{
+		Name:  os.Getenv("POD_NAME"),
+		vault: NewVaultClient(),
+		vaultChecker: vaultChecker{
+			store:        store,
+			elector:      elector,
+			bootstrapper: bootstrapper,
+			raft:         raft,
+		},
+	}
+
+	if s.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("POD_NAME is not set and the hostname is unknown: %s", err)
+		}
+		s.Name = hostname
+	}
+
+	return s, nil
+}
+
+// Check - initializes or joins, unseals or bootstraps vault depending on its state
+func (s *Sidecar) Check() {
+	s.check(kubeClient.Namespace, s.Name, s.vault)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSidecar(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+
+	vault := &fakeVault{name: "vault-1", sealed: true}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	store := &memoryKeyStore{}
+	store.Save(VaultToken{RootToken: "s.other", Tokens: []string{"other-key1", "other-key2", "other-key3"}})
+
+	elector := &LeaderElector{Name: "vault-init", Namespace: "vault", Identity: "vault-1", Duration: time.Minute}
+	s := &Sidecar{Name: "vault-1", vault: &VaultClient{Addr: vaultServer.URL}, vaultChecker: vaultChecker{store: store, elector: elector}}
+
+	// Another replica stored its keys and released the lease, so this one wins it but must not initialize
+	s.Check()
+	if vault.inits != 0 {
+		t.Fatal("expected vault not to be initialized while keys are stored")
+	}
+	if tokens, _ := store.Load(); tokens.RootToken != "s.other" {
+		t.Fatalf("expected the stored keys to be kept, got %+v", tokens)
+	}
+	if lease := fake.get("/apis/coordination.k8s.io/v1/namespaces/vault/leases/vault-init"); lease == nil || lease["spec"].(map[string]interface{})["holderIdentity"] != nil {
+		t.Fatalf("expected the lease to be released, got %v", lease)
+	}
+
+	store.Delete()
+	s.Check()
+	if vault.inits != 1 || vault.sealed {
+		t.Fatalf("expected vault to be initialized and unsealed, got %+v", vault)
+	}
+	tokens, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tokens.Tokens, ",") != strings.Join(vault.keys, ",") || tokens.VaultVersion != "1.4.2" {
+		t.Fatalf("expected the new keys to be stored, got %+v", tokens)
+	}
+
+	// A restarted vault is unsealed with the stored keys
+	vault.sealed = true
+	s.Check()
+	if vault.sealed || vault.inits != 1 {
+		t.Fatalf("expected vault to be unsealed without initializing it again, got %+v", vault)
+	}
+
+	submitted := vault.submitted
+	s.Check()
+	if vault.submitted != submitted {
+		t.Fatal("expected no keys to be sent to an unsealed vault")
+	}
+}
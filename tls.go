@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VaultTLS holds the TLS settings used to reach vault, reloading the certificate files when they change
+type VaultTLS struct {
+	CACert     string
+	CAPath     string
+	ClientCert string
+	ClientKey  string
+	ServerName string
+	SkipVerify bool
+
+	transport *http.Transport
+
+	mu      sync.Mutex
+	version string
+	roots   *x509.CertPool
+	certs   []tls.Certificate
+}
+
+// NewVaultTLS - reads the VAULT_CACERT, VAULT_CAPATH, VAULT_CLIENT_CERT, VAULT_CLIENT_KEY, VAULT_TLS_SERVER_NAME and VAULT_SKIP_VERIFY variables, returning nil if none is set
+func NewVaultTLS() (*VaultTLS, error) {
+	t := &VaultTLS{
+		CACert:     os.Getenv("VAULT_CACERT"),
+		CAPath:     os.Getenv("VAULT_CAPATH"),
+		ClientCert: os.Getenv("VAULT_CLIENT_CERT"),
+		ClientKey:  os.Getenv("VAULT_CLIENT_KEY"),
+		ServerName: os.Getenv("VAULT_TLS_SERVER_NAME"),
+	}
+
+	if skipVerify := os.Getenv("VAULT_SKIP_VERIFY"); skipVerify != "" {
+		var err error
+		t.SkipVerify, err = strconv.ParseBool(skipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("VAULT_SKIP_VERIFY is invalid: %s", err)
+		}
+	}
+
+	if t.CACert == "" && t.CAPath == "" && t.ClientCert == "" && t.ClientKey == "" && t.ServerName == "" && !t.SkipVerify {
+		return nil, nil
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return nil, errors.New("VAULT_CLIENT_CERT and VAULT_CLIENT_KEY must be set together")
+	}
+
+	// Fail at startup rather than on the first request
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// configureVaultTLS - makes httpClient use the TLS settings from the environment
+func configureVaultTLS() error {
+	t, err := NewVaultTLS()
+	if err != nil || t == nil {
+		return err
+	}
+
+	httpClient.Transport = t.Transport()
+	return nil
+}
+
+// Transport - returns an http.Transport dialing vault with the current certificates
+func (t *VaultTLS) Transport() *http.Transport {
+	t.transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialTLS:             t.dial,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return t.transport
+}
+
+// dial - opens a TLS connection to addr, reloading the certificates first if their files changed
+func (t *VaultTLS) dial(network, addr string) (net.Conn, error) {
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	config, err := t.config(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return tls.DialWithDialer(dialer, network, addr, config)
+}
+
+// config - returns the tls.Config for a connection to addr
+func (t *VaultTLS) config(addr string) (*tls.Config, error) {
+	serverName := t.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            t.roots,
+		Certificates:       t.certs,
+		InsecureSkipVerify: t.SkipVerify,
+	}, nil
+}
+
+// reload - reads the certificate files again if any of them changed since they were last read
+func (t *VaultTLS) reload() error {
+	version, err := t.fileVersion()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if version == t.version {
+		return nil
+	}
+
+	var roots *x509.CertPool
+	if t.CACert != "" || t.CAPath != "" {
+		roots = x509.NewCertPool()
+
+		files, err := t.caFiles()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if !roots.AppendCertsFromPEM(b) {
+				return fmt.Errorf("%s: no PEM certificates found", file)
+			}
+		}
+	}
+
+	var certs []tls.Certificate
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return fmt.Errorf("could not load the vault client certificate: %s", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	if t.version != "" {
+		logger.Infof("Vault TLS certificates changed, reloading them")
+	}
+
+	t.version, t.roots, t.certs = version, roots, certs
+
+	// Connections kept alive by the transport still use the old certificates
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// caFiles - lists VAULT_CACERT and the files in VAULT_CAPATH
+func (t *VaultTLS) caFiles() ([]string, error) {
+	var files []string
+	if t.CACert != "" {
+		files = append(files, t.CACert)
+	}
+
+	if t.CAPath != "" {
+		infos, err := ioutil.ReadDir(t.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			// Skip the ..data directories of mounted secrets and config maps
+			if info.IsDir() || info.Name()[0] == '.' {
+				continue
+			}
+			files = append(files, filepath.Join(t.CAPath, info.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// fileVersion - summarizes the modification time and size of every certificate file, following the symlinks Kubernetes swaps on updates
+func (t *VaultTLS) fileVersion() (string, error) {
+	files, err := t.caFiles()
+	if err != nil {
+		return "", err
+	}
+	if t.ClientCert != "" {
+		files = append(files, t.ClientCert, t.ClientKey)
+	}
+
+	version := ""
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+
+	return version, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCertificate - creates a self-signed certificate for vault.test, returning it and its PEM encoding
+func newTestCertificate(t *testing.T, name string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"vault.test"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestVaultTLSReload(t *testing.T) {
+	first, firstPEM := newTestCertificate(t, "first")
+	second, secondPEM := newTestCertificate(t, "second")
+
+	var mu sync.Mutex
+	current := &first
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	server.TLS = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return current, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "vault-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, firstPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server name is sent as SNI, so the server picks the certificate from GetCertificate
+	os.Setenv("VAULT_CACERT", caFile)
+	os.Setenv("VAULT_TLS_SERVER_NAME", "vault.test")
+	defer os.Unsetenv("VAULT_CACERT")
+	defer os.Unsetenv("VAULT_TLS_SERVER_NAME")
+
+	vaultTLS, err := NewVaultTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: vaultTLS.Transport()}
+	get := func() error {
+		response, err := client.Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(); err != nil {
+		t.Fatalf("expected the server to be trusted, got %s", err)
+	}
+
+	mu.Lock()
+	current = &second
+	mu.Unlock()
+	vaultTLS.transport.CloseIdleConnections()
+
+	if err := get(); err == nil {
+		t.Fatal("expected the rotated server certificate to be rejected until the CA file changes")
+	}
+
+	if err := ioutil.WriteFile(caFile, secondPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The rewrite may land within the file system's timestamp resolution
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, later, later)
+
+	if err := get(); err != nil {
+		t.Fatalf("expected the new CA file to be loaded, got %s", err)
+	}
+}
+
+func TestNewVaultTLS(t *testing.T) {
+	if vaultTLS, err := NewVaultTLS(); vaultTLS != nil || err != nil {
+		t.Fatalf("expected no TLS configuration without VAULT_* variables, got %v, %v", vaultTLS, err)
+	}
+
+	os.Setenv("VAULT_CLIENT_CERT", "/tmp/client.crt")
+	defer os.Unsetenv("VAULT_CLIENT_CERT")
+	if _, err := NewVaultTLS(); err == nil {
+		t.Fatal("expected an error when VAULT_CLIENT_KEY is missing")
+	}
+	os.Unsetenv("VAULT_CLIENT_CERT")
+
+	os.Setenv("VAULT_SKIP_VERIFY", "maybe")
+	defer os.Unsetenv("VAULT_SKIP_VERIFY")
+	if _, err := NewVaultTLS(); err == nil {
+		t.Fatal("expected an error for an invalid VAULT_SKIP_VERIFY")
+	}
+}
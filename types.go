@@ -9,8 +9,9 @@ type InitResponse struct {
 
 // UnsealRequest holds a Vault unseal request.
 type UnsealRequest struct {
-	Key   string `json:"key"`
-	Reset bool   `json:"reset"`
+	Key     string `json:"key"`
+	Reset   bool   `json:"reset"`
+	Migrate bool   `json:"migrate,omitempty"`
 }
 
 // UnsealResponse holds a Vault unseal response.
@@ -21,10 +22,122 @@ type UnsealResponse struct {
 	Progress int  `json:"progress"`
 }
 
+// SealStatusResponse holds a Vault seal-status response.
+type SealStatusResponse struct {
+	Type         string `json:"type"`
+	Initialized  bool   `json:"initialized"`
+	Sealed       bool   `json:"sealed"`
+	T            int    `json:"t"`
+	N            int    `json:"n"`
+	Progress     int    `json:"progress"`
+	Version      string `json:"version"`
+	RecoverySeal bool   `json:"recovery_seal"`
+	Migration    bool   `json:"migration"`
+	ClusterName  string `json:"cluster_name"`
+	ClusterID    string `json:"cluster_id"`
+}
+
+// HealthResponse holds the body of a Vault sys/health response, returned with every status code.
+type HealthResponse struct {
+	Initialized                bool   `json:"initialized"`
+	Sealed                     bool   `json:"sealed"`
+	Standby                    bool   `json:"standby"`
+	PerformanceStandby         bool   `json:"performance_standby"`
+	ReplicationPerformanceMode string `json:"replication_performance_mode"`
+	ReplicationDRMode          string `json:"replication_dr_mode"`
+	Version                    string `json:"version"`
+	ClusterName                string `json:"cluster_name"`
+	ClusterID                  string `json:"cluster_id"`
+}
+
 // InitRequest holds a Vault init request.
 type InitRequest struct {
-	SecretShares    int `json:"secret_shares"`
-	SecretThreshold int `json:"secret_threshold"`
+	SecretShares      int      `json:"secret_shares,omitempty"`
+	SecretThreshold   int      `json:"secret_threshold,omitempty"`
+	PGPKeys           []string `json:"pgp_keys,omitempty"`
+	RecoveryShares    int      `json:"recovery_shares,omitempty"`
+	RecoveryThreshold int      `json:"recovery_threshold,omitempty"`
+	RecoveryPGPKeys   []string `json:"recovery_pgp_keys,omitempty"`
+	RootTokenPGPKey   string   `json:"root_token_pgp_key,omitempty"`
+}
+
+// ShareRequest holds one key submitted to a rekey or generate-root update.
+type ShareRequest struct {
+	Key   string `json:"key"`
+	Nonce string `json:"nonce"`
+}
+
+// ShareProgress holds the progress fields shared by rekey and generate-root responses.
+type ShareProgress struct {
+	Nonce    string `json:"nonce"`
+	Started  bool   `json:"started"`
+	Progress int    `json:"progress"`
+	Required int    `json:"required"`
+	Complete bool   `json:"complete"`
+}
+
+// RekeyRequest holds a Vault rekey init request.
+type RekeyRequest struct {
+	SecretShares        int      `json:"secret_shares"`
+	SecretThreshold     int      `json:"secret_threshold"`
+	PGPKeys             []string `json:"pgp_keys,omitempty"`
+	RequireVerification bool     `json:"require_verification"`
+}
+
+// RekeyResponse holds a Vault rekey status, init or update response.
+type RekeyResponse struct {
+	ShareProgress
+	T                    int      `json:"t"`
+	N                    int      `json:"n"`
+	Keys                 []string `json:"keys"`
+	VerificationRequired bool     `json:"verification_required"`
+	VerificationNonce    string   `json:"verification_nonce"`
+}
+
+// GenerateRootRequest holds a Vault generate-root attempt request.
+type GenerateRootRequest struct {
+	OTP string `json:"otp,omitempty"`
+}
+
+// GenerateRootResponse holds a Vault generate-root status, attempt or update response.
+type GenerateRootResponse struct {
+	ShareProgress
+	OTP              string `json:"otp"`
+	OTPLength        int    `json:"otp_length"`
+	EncodedToken     string `json:"encoded_token"`
+	EncodedRootToken string `json:"encoded_root_token"`
+}
+
+// TokenCreateRequest holds a Vault token create request.
+type TokenCreateRequest struct {
+	Policies    []string `json:"policies"`
+	TTL         string   `json:"ttl,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+}
+
+// AuthResponse holds the auth block of a Vault login or token create response.
+type AuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// MountRequest holds a Vault request enabling an audit device, auth method or secrets engine.
+type MountRequest struct {
+	Type        string            `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Options     map[string]string `json:"options,omitempty"`
+}
+
+// MountInfo holds one entry of a Vault audit device, auth method or secrets engine listing.
+type MountInfo struct {
+	Type string `json:"type"`
+}
+
+// PolicyRequest holds a Vault ACL policy write request.
+type PolicyRequest struct {
+	Policy string `json:"policy"`
 }
 
 // Secret holds a kubernetes secret
@@ -35,34 +148,147 @@ type Secret struct {
 	Data       K8sSecrets `json:"data"`
 }
 
-// MetaData holds name for secret.
+// MetaData holds name, labels, annotations and owners for secret.
 type MetaData struct {
-	Name string `json:"name"`
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
 }
 
-// VaultToken holds root token and tokens to be added to secret.
-type VaultToken struct {
-	RootToken string   `json:"root_token"`
-	Tokens []string `json:"keys"`
+// OwnerReference links a Kubernetes object to the object that owns it.
+type OwnerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
 }
 
-// K8sSecrets holds root token and tokens to be added to secret.
-type K8sSecrets struct {
-	RootToken string  `json:"root-token"`
-	Token1    string  `json:"key1"`
-	Token2    string  `json:"key2"`
-	Token3    string  `json:"key3"`
-	Token4    string  `json:"key4"`
-	Token5    string  `json:"key5"`
+// KubernetesObject holds the metadata of any Kubernetes object.
+type KubernetesObject struct {
+	Kind       string   `json:"kind"`
+	APIVersion string   `json:"apiVersion"`
+	Metadata   MetaData `json:"metadata"`
 }
 
-// UnsealToken holds one token used to unseal vault.
-type UnsealToken struct {
-	UnsealKey string   `json:"key"`
+// VaultToken holds root token and tokens to be added to secret.
+type VaultToken struct {
+	RootToken    string   `json:"root_token"`
+	Tokens       []string `json:"keys"`
+	RecoveryKeys []string `json:"recovery_keys"`
+	RetiredKeys  []string `json:"retired_keys"`
+
+	// VaultVersion is the version of the vault that issued the keys, recorded with them but never read back
+	VaultVersion string `json:"-"`
+
+	// Threshold is how many of the keys the init or rekey request that issued them requires, recorded with them but never read back
+	Threshold int `json:"-"`
 }
 
+// K8sSecrets holds the base64 encoded root token ("root-token"), unseal keys ("key1".."keyN"), recovery keys ("recovery-key1".."recovery-keyN")
+// and keys retired by a seal migration ("retired-key1".."retired-keyN") of a secret.
+type K8sSecrets map[string]string
+
 // VaultResponse holds staus of vault.
 type VaultResponse struct {
-	Sealed bool   `json:"sealed"`
-	Progress int   `json:"progress"`
-}
\ No newline at end of file
+	Sealed   bool `json:"sealed"`
+	Progress int  `json:"progress"`
+}
+
+// Lease holds a coordination.k8s.io/v1 lease used for leader election.
+type Lease struct {
+	Kind       string    `json:"kind"`
+	APIVersion string    `json:"apiVersion"`
+	Metadata   MetaData  `json:"metadata"`
+	Spec       LeaseSpec `json:"spec"`
+}
+
+// LeaseSpec holds the current holder of a lease.
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// PodList holds the pods returned by a Kubernetes list request.
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// Pod holds the parts of a Kubernetes pod used to reach the Vault server in it.
+type Pod struct {
+	Metadata MetaData  `json:"metadata"`
+	Status   PodStatus `json:"status"`
+}
+
+// PodStatus holds the phase and address of a pod.
+type PodStatus struct {
+	Phase string `json:"phase"`
+	PodIP string `json:"podIP"`
+}
+
+// Endpoints holds the addresses of the pods behind a Kubernetes service.
+type Endpoints struct {
+	Subsets []EndpointSubset `json:"subsets"`
+}
+
+// EndpointSubset holds the ready and not ready addresses of an Endpoints object.
+type EndpointSubset struct {
+	Addresses         []EndpointAddress `json:"addresses"`
+	NotReadyAddresses []EndpointAddress `json:"notReadyAddresses"`
+}
+
+// EndpointAddress holds the IP and, behind a headless service, the hostname of a pod.
+type EndpointAddress struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+}
+
+// RaftJoinRequest holds a Vault integrated storage join request.
+type RaftJoinRequest struct {
+	LeaderAPIAddr       string `json:"leader_api_addr"`
+	LeaderCACert        string `json:"leader_ca_cert,omitempty"`
+	LeaderTLSServerName string `json:"leader_tls_servername,omitempty"`
+}
+
+// RaftJoinResponse holds the result of a Vault integrated storage join request.
+type RaftJoinResponse struct {
+	Joined bool `json:"joined"`
+}
+
+// Event holds a core/v1 event reported against a pod.
+type Event struct {
+	Kind               string          `json:"kind"`
+	APIVersion         string          `json:"apiVersion"`
+	Metadata           MetaData        `json:"metadata"`
+	InvolvedObject     ObjectReference `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             EventSource     `json:"source"`
+	FirstTimestamp     string          `json:"firstTimestamp"`
+	LastTimestamp      string          `json:"lastTimestamp"`
+	Count              int             `json:"count"`
+	ReportingComponent string          `json:"reportingComponent"`
+	ReportingInstance  string          `json:"reportingInstance"`
+}
+
+// ObjectReference points an event at the object it is about.
+type ObjectReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+}
+
+// EventSource names the component reporting an event.
+type EventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host,omitempty"`
+}
@@ -1,112 +1,381 @@
 package main
 
 import (
-	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"strings"
 )
 
-// Initialize - initialize vault
-func Initialize() VaultToken {
-	initRequest := InitRequest{
-		SecretShares:    NumTokens,
-		SecretThreshold: TokensRequired,
+// VaultClient talks to a single Vault server
+type VaultClient struct {
+	// Addr is the address of the server, such as http://127.0.0.1:8200
+	Addr string
+
+	// Token, when set, authenticates requests to endpoints that need a token
+	Token string
+}
+
+// NewVaultClient - creates a client for the Vault server at VAULT_ADDR
+func NewVaultClient() *VaultClient {
+	return &VaultClient{Addr: GetVaultURL("")}
+}
+
+// log - returns a logger adding the address of the server to every record
+func (v *VaultClient) log() *Logger {
+	return logger.With(Fields{"vault_addr": v.Addr})
+}
+
+// URL - crafts url for the given vault API path
+func (v *VaultClient) URL(path string) string {
+	return v.Addr + path
+}
+
+// Initialize - initialize vault, asking for recovery keys instead of unseal keys when it uses an auto-unseal seal
+func (v *VaultClient) Initialize() (VaultToken, error) {
+	status, err := v.SealStatus()
+	if err != nil {
+		return VaultToken{}, err
+	}
+
+	initRequest := InitRequest{}
+
+	if status.AutoUnseal() {
+		v.log().Infof("Vault uses a %s seal, initializing with recovery keys", status.Type)
+		initRequest.RecoveryShares = NumTokens
+		initRequest.RecoveryThreshold = TokensRequired
+	} else {
+		initRequest.SecretShares = NumTokens
+		initRequest.SecretThreshold = TokensRequired
+	}
+
+	if PGPKeys != nil {
+		if status.AutoUnseal() {
+			initRequest.RecoveryPGPKeys = PGPKeys.Keys
+		} else {
+			initRequest.PGPKeys = PGPKeys.Keys
+		}
+		initRequest.RootTokenPGPKey = PGPKeys.RootTokenKey
+	}
+
+	target := VaultToken{}
+	if err := v.request("PUT", "/v1/sys/init", initRequest, &target); err != nil {
+		return VaultToken{}, err
 	}
+	registerTokens(target)
+	target.VaultVersion = status.Version
+	target.Threshold = initRequest.SecretThreshold
+	if status.AutoUnseal() {
+		target.Threshold = initRequest.RecoveryThreshold
+	}
+
+	return target, nil
+}
 
-	r := toJSON(initRequest)
-	req, err := http.NewRequest("PUT", GetVaultURL("/v1/sys/init"), &r)
+// Unseal - unseal vault using the keys held in the key store, unless vault unseals itself with an auto-unseal seal
+func (v *VaultClient) Unseal(store KeyStore) error {
+	status, err := v.SealStatus()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !status.Sealed {
+		return nil
+	}
+	if status.Migration {
+		return v.Migrate(store)
+	}
+	if status.AutoUnseal() {
+		v.log().Infof("Vault unseals itself with its %s seal, recovery keys can not unseal it", status.Type)
+		return nil
 	}
 
-	res, err := httpClient.Do(req)
+	exists, err := store.Exists()
 	if err != nil {
-		panic(err)
+		return failure{"key_store", err}
+	}
+	if !exists {
+		return failure{"no_keys", errors.New("unseal: no unseal keys are stored")}
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		panic("init: non 200 status code: " + strconv.Itoa(res.StatusCode))
+	tokens, err := store.Load()
+	if err != nil {
+		return failure{"load_keys", fmt.Errorf("unseal: could not load unseal keys: %s", err)}
 	}
 
-	vaultResponse, err := ioutil.ReadAll(res.Body)
+	return v.submitKeys(status, tokens.Tokens, false)
+}
+
+// Migrate - unseals vault with migrate set while it moves between shamir and an auto-unseal seal, then rearranges the stored keys to match the new seal
+func (v *VaultClient) Migrate(store KeyStore) error {
+	status, err := v.SealStatus()
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
-	target := VaultToken{}
-	fromJSON(vaultResponse, &target)
-	return target
+	tokens, err := store.Load()
+	if err != nil {
+		return failure{"load_keys", fmt.Errorf("migrate: could not load keys: %s", err)}
+	}
+
+	// Moving off shamir takes the unseal keys, moving off an auto-unseal seal takes the recovery keys
+	keys := tokens.Tokens
+	if len(keys) == 0 {
+		keys = tokens.RecoveryKeys
+	}
+
+	v.log().Infof("Vault is migrating its seal, unsealing with migrate using %d stored keys", len(keys))
+
+	if err := v.submitKeys(status, keys, true); err != nil {
+		return err
+	}
+
+	return v.retireKeys(store)
+}
+
+// submitKeys - submits keys until vault is unsealed, discarding progress left by an earlier attempt and skipping keys vault rejects
+func (v *VaultClient) submitKeys(status SealStatusResponse, keys []string, migrate bool) error {
+	if len(keys) < status.T {
+		return failure{"not_enough_keys", fmt.Errorf("unseal: %d keys are required but only %d are stored", status.T, len(keys))}
+	}
+
+	// Progress from a crashed attempt may include keys from another set, so start over
+	if status.Progress > 0 {
+		v.log().Infof("Discarding unseal progress %d/%d left by an earlier attempt", status.Progress, status.T)
+		if _, err := v.unseal(UnsealRequest{Reset: true}); err != nil {
+			return err
+		}
+	}
+
+	rejected := 0
+	for i, key := range keys {
+		res, err := v.unseal(UnsealRequest{Key: key, Migrate: migrate})
+		if vaultErr, ok := err.(*VaultError); ok && vaultErr.StatusCode == 400 {
+			v.log().With(Fields{"attempt": i + 1}).Warnf("Vault rejected key%d: %s", i+1, vaultErr)
+			rejected++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !res.Sealed {
+			v.log().Infof("Vault is unsealed after %d keys", i+1)
+			return nil
+		}
+
+		v.log().Infof("Unseal progress %d/%d", res.Progress, res.T)
+	}
+
+	return failure{"keys_rejected", fmt.Errorf("unseal: vault is still sealed after using all %d stored keys, %d were rejected and %d are required", len(keys), rejected, status.T)}
 }
 
-// Unseal - unseal vault
-func Unseal() {
-	exists, err := IsSecretExists()
-	if exists == false {
-		log.Print("Secrets do not exist!")
-		panic(err)
+// retireKeys - stores the keys used for a completed seal migration as the keys of the new seal, keeping the old entries as retired keys
+func (v *VaultClient) retireKeys(store KeyStore) error {
+	status, err := v.SealStatus()
+	if err != nil {
+		return err
 	}
 
-	secrets := GetSecret()
-	token1, error := base64.StdEncoding.DecodeString(secrets.Data.Token1)
-	if error != nil {
-		log.Print("Could not decode token1")
-		panic(error)
+	// The PGP encrypted shares are moved as they are, so custodians keep the share they already hold
+	if pgpStore, ok := store.(*PGPKeyStore); ok {
+		store = pgpStore.KeyStore
 	}
-	token2, error := base64.StdEncoding.DecodeString(secrets.Data.Token2)
-	if error != nil {
-		log.Print("Could not decode token2")
-		panic(error)
+
+	tokens, err := store.Load()
+	if err != nil {
+		return err
 	}
-	token3, error := base64.StdEncoding.DecodeString(secrets.Data.Token3)
-	if error != nil {
-		log.Print("Could not decode token3")
-		panic(error)
+
+	// The values do not change, shamir unseal keys become recovery keys and recovery keys become unseal keys
+	switch {
+	case status.AutoUnseal() && len(tokens.Tokens) > 0:
+		v.log().Infof("Seal migrated to %s, storing the unseal keys as recovery keys", status.Type)
+		tokens.RetiredKeys = tokens.Tokens
+		tokens.RecoveryKeys = tokens.Tokens
+		tokens.Tokens = nil
+	case !status.AutoUnseal() && len(tokens.RecoveryKeys) > 0:
+		v.log().Infof("Seal migrated to %s, storing the recovery keys as unseal keys", status.Type)
+		tokens.RetiredKeys = tokens.RecoveryKeys
+		tokens.Tokens = tokens.RecoveryKeys
+		tokens.RecoveryKeys = nil
+	default:
+		// Another node or replica already rearranged the keys
+		return nil
 	}
 
-	UseKey(string(token1[:]))
-	UseKey(string(token2[:]))
-	UseKey(string(token3[:]))
+	tokens.VaultVersion = status.Version
+	return store.Save(tokens)
 }
 
-// UseKey - uses a key to unseal vault
-func UseKey(key string) {
-	unsealToken := UnsealToken{
-		UnsealKey: key,
+// UseKey - uses a key to unseal vault, returning the resulting seal status
+func (v *VaultClient) UseKey(key string) (UnsealResponse, error) {
+	return v.unseal(UnsealRequest{Key: key})
+}
+
+// unseal - submits an unseal request, returning the resulting seal status or a *VaultError if vault refused it
+func (v *VaultClient) unseal(unsealRequest UnsealRequest) (UnsealResponse, error) {
+	registerSecrets(unsealRequest.Key)
+
+	target := UnsealResponse{}
+	b := toJSON(unsealRequest)
+
+	req, err := http.NewRequest("PUT", v.URL("/v1/sys/unseal"), &b)
+	if err != nil {
+		return target, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return target, err
+	}
+	defer res.Body.Close()
+
+	vaultResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return target, err
+	}
+
+	if res.StatusCode != 200 {
+		return target, newVaultError(res.StatusCode, vaultResponse)
 	}
 
-	b := toJSON(unsealToken)
+	if err := json.Unmarshal(vaultResponse, &target); err != nil {
+		return target, fmt.Errorf("unseal: %s", err)
+	}
+	return target, nil
+}
+
+// request - sends body as JSON to the vault API path and decodes the response into target, returning a *VaultError for non 2xx responses
+func (v *VaultClient) request(method, path string, body, target interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b := toJSON(body)
+		r = &b
+	}
 
-	req, err := http.NewRequest("PUT", GetVaultURL("/v1/sys/unseal"), &b)
+	req, err := http.NewRequest(method, v.URL(path), r)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
+	if v.Token != "" {
+		registerSecrets(v.Token)
+		req.Header.Add("X-Vault-Token", v.Token)
+	}
 
 	res, err := httpClient.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer res.Body.Close()
 
 	vaultResponse, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newVaultError(res.StatusCode, vaultResponse)
+	}
+
+	if target == nil || len(vaultResponse) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(vaultResponse, target)
+}
+
+// submitShares - submits keys to a rekey or generate-root update path until vault reports the operation complete,
+// skipping keys vault rejects, and decodes the completing response into target
+func (v *VaultClient) submitShares(path, nonce string, keys []string, target interface{}) error {
+	registerSecrets(keys...)
+	rejected := 0
+
+	for i, key := range keys {
+		var response json.RawMessage
+		err := v.request("PUT", path, ShareRequest{Key: key, Nonce: nonce}, &response)
+		if vaultErr, ok := err.(*VaultError); ok && vaultErr.StatusCode == 400 {
+			v.log().With(Fields{"attempt": i + 1}).Warnf("Vault rejected key%d: %s", i+1, vaultErr)
+			rejected++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		progress := ShareProgress{}
+		if err := json.Unmarshal(response, &progress); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		if progress.Complete {
+			return json.Unmarshal(response, target)
+		}
+
+		v.log().Infof("%s progress %d/%d", path, progress.Progress, progress.Required)
+	}
+
+	return fmt.Errorf("%s: not complete after using all %d stored keys, %d were rejected", path, len(keys), rejected)
+}
+
+// SealStatus - reads the seal status of vault
+func (v *VaultClient) SealStatus() (SealStatusResponse, error) {
+	target := SealStatusResponse{}
+
+	res, err := httpClient.Get(v.URL("/v1/sys/seal-status"))
+	if err != nil {
+		return target, err
+	}
+	defer res.Body.Close()
+
+	vaultResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return target, err
 	}
 
 	if res.StatusCode != 200 {
-		log.Printf("Status Code: %d", res.StatusCode)
-		log.Printf("Body: %+v", vaultResponse)
+		return target, fmt.Errorf("seal-status: non 200 status code: %d", res.StatusCode)
+	}
 
-		panic("init: non 200 status code: " + strconv.Itoa(res.StatusCode))
+	if err := json.Unmarshal(vaultResponse, &target); err != nil {
+		return target, fmt.Errorf("seal-status: %s", err)
 	}
+	return target, nil
+}
+
+// VaultError is a non 200 response from vault
+type VaultError struct {
+	StatusCode int
+	Errors     []string `json:"errors"`
+}
+
+// newVaultError - builds a VaultError from a response body holding an errors list
+func newVaultError(statusCode int, body []byte) *VaultError {
+	e := &VaultError{}
+	// Bodies that are not JSON still produce an error naming the status code
+	json.Unmarshal(body, e)
+	e.StatusCode = statusCode
+	return e
+}
+
+// Error - describes the status code and the errors reported by vault
+func (e *VaultError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("non 200 status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
 
-	target := VaultResponse{}
-	fromJSON(vaultResponse, &target)
+// AutoUnseal - reports whether vault unseals itself with a seal such as awskms, gcpckms or transit
+func (s SealStatusResponse) AutoUnseal() bool {
+	return s.RecoverySeal || (s.Type != "" && s.Type != "shamir")
 }
 
 // GetVaultURL - crafts url for vault
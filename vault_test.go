@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInitializeAutoUnseal(t *testing.T) {
+	var initRequest map[string]interface{}
+	unsealed := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/seal-status":
+			json.NewEncoder(w).Encode(SealStatusResponse{Type: "gcpckms", RecoverySeal: true, Sealed: true, Version: "1.4.2"})
+		case "/v1/sys/init":
+			json.NewDecoder(r.Body).Decode(&initRequest)
+			json.NewEncoder(w).Encode(VaultToken{RootToken: "s.root", RecoveryKeys: []string{"r1", "r2"}})
+		case "/v1/sys/unseal":
+			unsealed = true
+		}
+	}))
+	defer server.Close()
+
+	vault := &VaultClient{Addr: server.URL}
+
+	tokens, err := vault.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.RecoveryKeys) != 2 || len(tokens.Tokens) != 0 || tokens.VaultVersion != "1.4.2" {
+		t.Fatalf("expected two recovery keys from vault 1.4.2, got %+v", tokens)
+	}
+	if initRequest["recovery_shares"] == nil || initRequest["secret_shares"] != nil {
+		t.Fatalf("expected recovery parameters only, got %v", initRequest)
+	}
+
+	store := &memoryKeyStore{}
+	store.Save(tokens)
+
+	if err := vault.Unseal(store); err != nil {
+		t.Fatal(err)
+	}
+	if unsealed {
+		t.Fatal("expected recovery keys not to be submitted to the unseal endpoint")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	var submitted []UnsealRequest
+	migrated := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/seal-status":
+			if migrated {
+				json.NewEncoder(w).Encode(SealStatusResponse{Type: "transit", RecoverySeal: true})
+			} else {
+				json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Sealed: true, Migration: true})
+			}
+		case "/v1/sys/unseal":
+			var req UnsealRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			submitted = append(submitted, req)
+			migrated = len(submitted) == 2
+			json.NewEncoder(w).Encode(UnsealResponse{Sealed: !migrated, T: 2, N: 3, Progress: len(submitted) % 2})
+		}
+	}))
+	defer server.Close()
+
+	store := &memoryKeyStore{}
+	store.Save(VaultToken{Tokens: []string{"k1", "k2", "k3"}})
+
+	if err := (&VaultClient{Addr: server.URL}).Unseal(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(submitted) != 2 || !submitted[0].Migrate || !submitted[1].Migrate {
+		t.Fatalf("expected two unseal requests with migrate set, got %+v", submitted)
+	}
+
+	tokens, _ := store.Load()
+	if len(tokens.Tokens) != 0 || len(tokens.RecoveryKeys) != 3 || len(tokens.RetiredKeys) != 3 {
+		t.Fatalf("expected the unseal keys to become recovery keys, got %+v", tokens)
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	var submitted []UnsealRequest
+	progress := 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/seal-status":
+			json.NewEncoder(w).Encode(SealStatusResponse{Type: "shamir", Sealed: true, T: 2, N: 4, Progress: progress})
+		case "/v1/sys/unseal":
+			var req UnsealRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			submitted = append(submitted, req)
+
+			switch {
+			case req.Reset:
+				progress = 0
+			case req.Key == "bad":
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors":["invalid key"]}`))
+				return
+			default:
+				progress++
+			}
+			json.NewEncoder(w).Encode(UnsealResponse{Sealed: progress < 2, T: 2, N: 4, Progress: progress})
+		}
+	}))
+	defer server.Close()
+
+	vault := &VaultClient{Addr: server.URL}
+	store := &memoryKeyStore{}
+	store.Save(VaultToken{Tokens: []string{"k1", "bad", "k3", "k4"}})
+
+	if err := vault.Unseal(store); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 4 || !submitted[0].Reset || submitted[3].Key != "k3" {
+		t.Fatalf("expected a reset then k1, bad and k3, got %+v", submitted)
+	}
+
+	progress = 0
+	store.Save(VaultToken{Tokens: []string{"k1", "bad", "bad"}})
+	err := vault.Unseal(store)
+	if err == nil || !strings.Contains(err.Error(), "2 were rejected") {
+		t.Fatalf("expected an error naming the rejected keys, got %v", err)
+	}
+
+	store.Save(VaultToken{Tokens: []string{"k1"}})
+	if err := vault.Unseal(store); err == nil {
+		t.Fatal("expected an error with fewer keys than the threshold")
+	}
+}
+
+func TestSealStatusMalformed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>bad gateway</html>"))
+	}))
+	defer server.Close()
+
+	if _, err := (&VaultClient{Addr: server.URL}).SealStatus(); err == nil || !strings.Contains(err.Error(), "seal-status") {
+		t.Fatalf("expected a malformed response to be returned as an error, got %v", err)
+	}
+}